@@ -2,7 +2,10 @@
 // implementation of that interface.
 package wabbit
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 type (
 	// Option is a map of AMQP configurations
@@ -24,21 +27,42 @@ type (
 
 		Confirm(noWait bool) error
 		NotifyPublish(confirm chan Confirmation) chan Confirmation
+		PublishWithDeferredConfirm(exc, route string, msg []byte, opt Option) (DeferredConfirmation, error)
+		NotifyReturn(ret chan Return) chan Return
+
+		Tx() error
+		TxCommit() error
+		TxRollback() error
 
 		Cancel(consumer string, noWait bool) error
 		ExchangeDeclare(name, kind string, opt Option) error
+		ExchangeDeclareWithContext(ctx context.Context, name, kind string, opt Option) error
 		ExchangeDeclarePassive(name, kind string, opt Option) error
 		QueueInspect(name string) (Queue, error)
 		QueueDeclare(name string, args Option) (Queue, error)
+		QueueDeclareWithContext(ctx context.Context, name string, args Option) (Queue, error)
 		QueueDeclarePassive(name string, args Option) (Queue, error)
 		QueueDelete(name string, args Option) (int, error)
 		QueueBind(name, key, exchange string, opt Option) error
+		QueueBindWithContext(ctx context.Context, name, key, exchange string, opt Option) error
 		QueueUnbind(name, route, exchange string, args Option) error
 		Consume(queue, consumer string, opt Option) (<-chan Delivery, error)
+
+		// ConsumeWithContext is like Consume, but the consumer is
+		// also cancelled when ctx is done.
+		ConsumeWithContext(ctx context.Context, queue, consumer string, opt Option) (<-chan Delivery, error)
+
+		Get(queue string, opt Option) (Delivery, bool, error)
 		Qos(prefetchCount, prefetchSize int, global bool) error
 		Close() error
 		NotifyClose(chan Error) chan Error
 		Publisher
+
+		// PublishWithContext is like Publish, but returns ctx.Err()
+		// when ctx is done before the message is sent. Once the
+		// message is being written, ctx is ignored: a blocked write
+		// isn't cancelled.
+		PublishWithContext(ctx context.Context, exc, route string, msg []byte, opt Option) error
 	}
 
 	// Queue is a AMQP queue interface
@@ -63,9 +87,41 @@ type (
 		Headers() Option
 		DeliveryTag() uint64
 		ConsumerTag() string
+		Redelivered() bool
+		Exchange() string
+		RoutingKey() string
+
+		// message properties, see the publish options
 		MessageId() string
 		ContentType() string
+		ContentEncoding() string
+		DeliveryMode() uint8
+		Priority() uint8
+		CorrelationId() string
+		ReplyTo() string
+		Expiration() string
 		Timestamp() time.Time
+		Type() string
+		UserId() string
+		AppId() string
+
+		// MessageCount is the number of messages remaining in the
+		// queue after a Get. It's zero for consumed deliveries.
+		MessageCount() uint32
+	}
+
+	// Return is a message published with the mandatory option and
+	// returned by the broker because it couldn't be routed to any queue.
+	Return struct {
+		ReplyCode  uint16 // reason of the return, eg.: 312 (NO_ROUTE)
+		ReplyText  string
+		Exchange   string
+		RoutingKey string
+		Body       []byte
+
+		// Properties of the message using the same keys of the
+		// Publish options, eg.: "headers", "contentType"
+		Properties Option
 	}
 
 	// Confirmation is an interface to confrimation messages
@@ -74,6 +130,23 @@ type (
 		DeliveryTag() uint64
 	}
 
+	// DeferredConfirmation is the publisher confirmation of a single
+	// message, returned by PublishWithDeferredConfirm
+	DeferredConfirmation interface {
+		DeliveryTag() uint64
+
+		// Done is closed when the message is confirmed
+		Done() <-chan struct{}
+
+		// Acked reports the confirmation without blocking. It's false
+		// while the message isn't confirmed or when it's nacked.
+		Acked() bool
+
+		// Wait blocks until the message is confirmed, then reports if
+		// it was acked, or until ctx is done returning ctx.Err().
+		Wait(ctx context.Context) (bool, error)
+	}
+
 	// Error is an interface for AMQP errors
 	Error interface {
 		Code() int
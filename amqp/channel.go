@@ -1,6 +1,7 @@
 package amqp
 
 import (
+	"context"
 	"errors"
 
 	"github.com/NeowayLabs/wabbit"
@@ -14,27 +15,91 @@ type Channel struct {
 }
 
 func (ch *Channel) Publish(exc, route string, msg []byte, opt wabbit.Option) error {
-	amqpOpt, err := utils.ConvertOpt(opt)
+	mandatory, amqpOpt, err := publishing(msg, opt)
 
 	if err != nil {
 		return err
 	}
 
-	amqpOpt.Body = msg
-
 	return ch.Channel.Publish(
-		exc,   // publish to an exchange
-		route, // routing to 0 or more queues
-		false, // mandatory
-		false, // immediate
+		exc,       // publish to an exchange
+		route,     // routing to 0 or more queues
+		mandatory, // return the message when it's unroutable
+		false,     // immediate
 		amqpOpt,
 	)
 }
 
+// PublishWithContext publishes the message unless ctx is already done.
+// ctx isn't passed down, amqp091 ignores it: a blocked write isn't
+// aborted.
+func (ch *Channel) PublishWithContext(ctx context.Context, exc, route string, msg []byte, opt wabbit.Option) error {
+	return withContext(ctx, func() error {
+		return ch.Publish(exc, route, msg, opt)
+	})
+}
+
+// PublishWithDeferredConfirm publishes the message and returns its
+// publisher confirmation. It returns a nil confirmation when the channel
+// isn't in confirm mode.
+func (ch *Channel) PublishWithDeferredConfirm(exc, route string, msg []byte, opt wabbit.Option) (wabbit.DeferredConfirmation, error) {
+	mandatory, amqpOpt, err := publishing(msg, opt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dc, err := ch.Channel.PublishWithDeferredConfirm(exc, route, mandatory, false, amqpOpt)
+
+	if err != nil || dc == nil {
+		return nil, err
+	}
+
+	return DeferredConfirmation{dc}, nil
+}
+
+// publishing converts the publish options
+func publishing(msg []byte, opt wabbit.Option) (bool, amqp.Publishing, error) {
+	var mandatory bool
+
+	if v, ok := opt["mandatory"]; ok {
+		mandatory, ok = v.(bool)
+
+		if !ok {
+			return false, amqp.Publishing{}, errors.New("mandatory option is of type bool")
+		}
+	}
+
+	amqpOpt, err := utils.ConvertOpt(opt)
+
+	if err != nil {
+		return false, amqp.Publishing{}, err
+	}
+
+	amqpOpt.Body = msg
+
+	return mandatory, amqpOpt, nil
+}
+
 func (ch *Channel) Confirm(noWait bool) error {
 	return ch.Channel.Confirm(noWait)
 }
 
+// Tx puts the channel in transactional mode
+func (ch *Channel) Tx() error {
+	return ch.Channel.Tx()
+}
+
+// TxCommit atomically commits the publishes and acks of the transaction
+func (ch *Channel) TxCommit() error {
+	return ch.Channel.TxCommit()
+}
+
+// TxRollback discards the publishes and acks of the transaction
+func (ch *Channel) TxRollback() error {
+	return ch.Channel.TxRollback()
+}
+
 func (ch *Channel) NotifyPublish(confirm chan wabbit.Confirmation) chan wabbit.Confirmation {
 	amqpConfirms := ch.Channel.NotifyPublish(make(chan amqp.Confirmation, cap(confirm)))
 
@@ -49,7 +114,53 @@ func (ch *Channel) NotifyPublish(confirm chan wabbit.Confirmation) chan wabbit.C
 	return confirm
 }
 
+// NotifyReturn registers a listener for the mandatory messages returned
+// by the broker.
+func (ch *Channel) NotifyReturn(ret chan wabbit.Return) chan wabbit.Return {
+	amqpReturns := ch.Channel.NotifyReturn(make(chan amqp.Return, cap(ret)))
+
+	go func() {
+		for r := range amqpReturns {
+			ret <- wabbit.Return{
+				ReplyCode:  r.ReplyCode,
+				ReplyText:  r.ReplyText,
+				Exchange:   r.Exchange,
+				RoutingKey: r.RoutingKey,
+				Body:       r.Body,
+				Properties: wabbit.Option{
+					"headers":         r.Headers,
+					"contentType":     r.ContentType,
+					"contentEncoding": r.ContentEncoding,
+					"deliveryMode":    r.DeliveryMode,
+					"priority":        r.Priority,
+					"messageId":       r.MessageId,
+					"correlationId":   r.CorrelationId,
+					"replyTo":         r.ReplyTo,
+					"expiration":      r.Expiration,
+					"timestamp":       r.Timestamp,
+					"type":            r.Type,
+					"userId":          r.UserId,
+					"appId":           r.AppId,
+				},
+			}
+		}
+
+		close(ret)
+	}()
+
+	return ret
+}
+
 func (ch *Channel) Consume(queue, consumer string, opt wabbit.Option) (<-chan wabbit.Delivery, error) {
+	return ch.consume(context.Background(), queue, consumer, opt)
+}
+
+// ConsumeWithContext starts a consumer that is cancelled when ctx is done
+func (ch *Channel) ConsumeWithContext(ctx context.Context, queue, consumer string, opt wabbit.Option) (<-chan wabbit.Delivery, error) {
+	return ch.consume(ctx, queue, consumer, opt)
+}
+
+func (ch *Channel) consume(ctx context.Context, queue, consumer string, opt wabbit.Option) (<-chan wabbit.Delivery, error) {
 	var (
 		autoAck, exclusive, noLocal, noWait bool
 		args                                amqp.Table
@@ -95,7 +206,9 @@ func (ch *Channel) Consume(queue, consumer string, opt wabbit.Option) (<-chan wa
 		}
 	}
 
-	amqpd, err := ch.Channel.Consume(queue, consumer, autoAck, exclusive, noLocal, noWait, args)
+	// amqp091 cancels the consumer when ctx is done, even while the
+	// consume is in progress.
+	amqpd, err := ch.Channel.ConsumeWithContext(ctx, queue, consumer, autoAck, exclusive, noLocal, noWait, args)
 
 	if err != nil {
 		return nil, err
@@ -115,10 +228,40 @@ func (ch *Channel) Consume(queue, consumer string, opt wabbit.Option) (<-chan wa
 	return deliveries, nil
 }
 
+// Get synchronously receives a single message from the queue. The bool
+// result is false when the queue is empty.
+func (ch *Channel) Get(queue string, opt wabbit.Option) (wabbit.Delivery, bool, error) {
+	var autoAck bool
+
+	if v, ok := opt["autoAck"]; ok {
+		autoAck, ok = v.(bool)
+
+		if !ok {
+			return nil, false, errors.New("autoAck option is of type bool")
+		}
+	}
+
+	d, ok, err := ch.Channel.Get(queue, autoAck)
+
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	return &Delivery{&d}, true, nil
+}
+
 func (ch *Channel) ExchangeDeclare(name, kind string, opt wabbit.Option) error {
 	return ch.exchangeDeclare(name, kind, false, opt)
 }
 
+// ExchangeDeclareWithContext declares the exchange unless ctx is already
+// done. A declare in progress isn't aborted by ctx.
+func (ch *Channel) ExchangeDeclareWithContext(ctx context.Context, name, kind string, opt wabbit.Option) error {
+	return withContext(ctx, func() error {
+		return ch.exchangeDeclare(name, kind, false, opt)
+	})
+}
+
 func (ch *Channel) ExchangeDeclarePassive(name, kind string, opt wabbit.Option) error {
 	return ch.exchangeDeclare(name, kind, true, opt)
 }
@@ -209,11 +352,32 @@ func (ch *Channel) QueueBind(name, key, exchange string, opt wabbit.Option) erro
 	return ch.Channel.QueueBind(name, key, exchange, noWait, args)
 }
 
+// QueueBindWithContext binds the route key to queue unless ctx is
+// already done. A bind in progress isn't aborted by ctx.
+func (ch *Channel) QueueBindWithContext(ctx context.Context, name, key, exchange string, opt wabbit.Option) error {
+	return withContext(ctx, func() error {
+		return ch.QueueBind(name, key, exchange, opt)
+	})
+}
+
 // QueueDeclare declares a new AMQP queue
 func (ch *Channel) QueueDeclare(name string, opt wabbit.Option) (wabbit.Queue, error) {
 	return ch.queueDeclare(name, false, opt)
 }
 
+// QueueDeclareWithContext declares a new AMQP queue unless ctx is already
+// done. A declare in progress isn't aborted by ctx.
+func (ch *Channel) QueueDeclareWithContext(ctx context.Context, name string, opt wabbit.Option) (wabbit.Queue, error) {
+	var q wabbit.Queue
+
+	err := withContext(ctx, func() (err error) {
+		q, err = ch.queueDeclare(name, false, opt)
+		return err
+	})
+
+	return q, err
+}
+
 // QueueDeclarePassive declares an existing AMQP queue
 func (ch *Channel) QueueDeclarePassive(name string, opt wabbit.Option) (wabbit.Queue, error) {
 	return ch.queueDeclare(name, true, opt)
@@ -342,3 +506,14 @@ func (ch *Channel) NotifyClose(c chan wabbit.Error) chan wabbit.Error {
 
 	return c
 }
+
+// withContext runs fn unless ctx is already done. The amqp091 calls
+// can't be aborted once sent, then fn isn't abandoned when ctx is done
+// meanwhile: returning ctx.Err() would hide a call that succeeded.
+func withContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return fn()
+}
@@ -0,0 +1,403 @@
+package amqp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/NeowayLabs/wabbit"
+	"github.com/NeowayLabs/wabbit/amqptest/server"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// listen starts a fake server on a free port and returns a channel
+// connected to it over the wire. No broker is needed.
+func listen(t *testing.T, amqpuri string) (*server.AMQPServer, *Conn, wabbit.Channel) {
+	srv := server.NewServer(amqpuri)
+
+	if err := srv.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := Dial("amqp://guest:guest@" + srv.Addr().String() + "/")
+
+	if err != nil {
+		srv.Stop()
+		t.Fatal(err)
+	}
+
+	ch, err := conn.Channel()
+
+	if err != nil {
+		conn.Close()
+		srv.Stop()
+		t.Fatal(err)
+	}
+
+	return srv, conn, ch
+}
+
+// declare declares a server named queue, new on every run
+func declare(t *testing.T, ch wabbit.Channel) wabbit.Queue {
+	q, err := ch.QueueDeclare("", wabbit.Option{"exclusive": true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return q
+}
+
+func TestNotifyReturn(t *testing.T) {
+	srv, conn, ch := listen(t, "amqp://localhost:35710/%2f")
+	defer srv.Stop()
+	defer conn.Close()
+
+	returns := ch.NotifyReturn(make(chan wabbit.Return, 1))
+
+	err := ch.Publish("", "no-such-queue", []byte("teste"), wabbit.Option{
+		"mandatory":   true,
+		"contentType": "application/json",
+		"headers":     amqp.Table{"trace": "1"},
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case r := <-returns:
+		if r.ReplyCode != 312 || r.RoutingKey != "no-such-queue" || string(r.Body) != "teste" {
+			t.Errorf("Unexpected return: %+v", r)
+			return
+		}
+
+		if r.Properties["contentType"] != "application/json" {
+			t.Errorf("Unexpected content type of the return: %v", r.Properties["contentType"])
+			return
+		}
+
+		if headers, _ := r.Properties["headers"].(amqp.Table); headers["trace"] != "1" {
+			t.Errorf("Unexpected headers of the return: %v", r.Properties["headers"])
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Mandatory message not returned")
+	}
+}
+
+func TestGet(t *testing.T) {
+	srv, conn, ch := listen(t, "amqp://localhost:35711/%2f")
+	defer srv.Stop()
+	defer conn.Close()
+
+	q := declare(t, ch)
+
+	if _, ok, err := ch.Get(q.Name(), nil); err != nil || ok {
+		t.Errorf("Get from an empty queue shall return nothing: %v %v", ok, err)
+		return
+	}
+
+	for _, body := range []string{"first", "second"} {
+		if err := ch.Publish("", q.Name(), []byte(body), nil); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	d, ok, err := ch.Get(q.Name(), nil)
+
+	if err != nil || !ok {
+		t.Errorf("Message not found: %v", err)
+		return
+	}
+
+	if string(d.Body()) != "first" || d.MessageCount() != 1 {
+		t.Errorf("Unexpected message %q with %d remaining", d.Body(), d.MessageCount())
+		return
+	}
+
+	if err = d.Ack(false); err != nil {
+		t.Error(err)
+		return
+	}
+
+	d, ok, err = ch.Get(q.Name(), wabbit.Option{"autoAck": true})
+
+	if err != nil || !ok || string(d.Body()) != "second" {
+		t.Errorf("Unexpected get: %v %v", ok, err)
+		return
+	}
+
+	if _, _, err = ch.Get(q.Name(), wabbit.Option{"autoAck": "yes"}); err == nil {
+		t.Errorf("Get shall fail with an autoAck option of invalid type")
+	}
+}
+
+func TestTx(t *testing.T) {
+	srv, conn, ch := listen(t, "amqp://localhost:35712/%2f")
+	defer srv.Stop()
+	defer conn.Close()
+
+	q := declare(t, ch)
+
+	if err := ch.Tx(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, commit := range []bool{false, true} {
+		if err := ch.Publish("", q.Name(), []byte("teste"), nil); err != nil {
+			t.Error(err)
+			return
+		}
+
+		var err error
+
+		if commit {
+			err = ch.TxCommit()
+		} else {
+			err = ch.TxRollback()
+		}
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	q, err := ch.QueueDeclarePassive(q.Name(), wabbit.Option{"exclusive": true})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if q.Messages() != 1 {
+		t.Errorf("Expected only the committed message in the queue: %d", q.Messages())
+	}
+}
+
+func TestPublishWithDeferredConfirm(t *testing.T) {
+	srv, conn, ch := listen(t, "amqp://localhost:35713/%2f")
+	defer srv.Stop()
+	defer conn.Close()
+
+	q := declare(t, ch)
+
+	dc, err := ch.PublishWithDeferredConfirm("", q.Name(), []byte("teste"), nil)
+
+	if err != nil || dc != nil {
+		t.Errorf("Publish without confirm mode shall return no confirmation: %v %v", dc, err)
+		return
+	}
+
+	if err = ch.Confirm(false); err != nil {
+		t.Error(err)
+		return
+	}
+
+	for tag := uint64(1); tag <= 2; tag++ {
+		dc, err = ch.PublishWithDeferredConfirm("", q.Name(), []byte("teste"), nil)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if dc.DeliveryTag() != tag {
+			t.Errorf("Unexpected delivery tag %d, expected %d", dc.DeliveryTag(), tag)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		acked, err := dc.Wait(ctx)
+		cancel()
+
+		if err != nil || !acked {
+			t.Errorf("Publish not acked: %v", err)
+			return
+		}
+
+		select {
+		case <-dc.Done():
+		default:
+			t.Errorf("Done not closed after the confirm")
+			return
+		}
+
+		if !dc.Acked() {
+			t.Errorf("Acked shall report the ack")
+			return
+		}
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	srv, conn, ch := listen(t, "amqp://localhost:35714/%2f")
+	defer srv.Stop()
+	defer conn.Close()
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := ch.PublishWithContext(cancelled, "", "data", []byte("teste"), nil); err != context.Canceled {
+		t.Errorf("PublishWithContext shall fail with the cancelled context: %v", err)
+		return
+	}
+
+	if _, err := ch.QueueDeclareWithContext(cancelled, "data", nil); err != context.Canceled {
+		t.Errorf("QueueDeclareWithContext shall fail with the cancelled context: %v", err)
+		return
+	}
+
+	if err := ch.ExchangeDeclareWithContext(cancelled, "neoway", "topic", nil); err != context.Canceled {
+		t.Errorf("ExchangeDeclareWithContext shall fail with the cancelled context: %v", err)
+		return
+	}
+
+	if err := ch.QueueBindWithContext(cancelled, "data", "#", "neoway", nil); err != context.Canceled {
+		t.Errorf("QueueBindWithContext shall fail with the cancelled context: %v", err)
+		return
+	}
+
+	if _, err := ch.ConsumeWithContext(cancelled, "data", "", nil); err != context.Canceled {
+		t.Errorf("ConsumeWithContext shall fail with the cancelled context: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q, err := ch.QueueDeclareWithContext(ctx, "", wabbit.Option{"exclusive": true})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ch.ExchangeDeclareWithContext(ctx, "neoway", "topic", nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ch.QueueBindWithContext(ctx, q.Name(), "#", "neoway", nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	deliveries, err := ch.ConsumeWithContext(ctx, q.Name(), "", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ch.PublishWithContext(ctx, "neoway", "data", []byte("teste"), nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case d := <-deliveries:
+		if string(d.Body()) != "teste" {
+			t.Errorf("Unexpected delivery: %q", d.Body())
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Message not delivered")
+		return
+	}
+
+	// cancelling ctx cancels the consumer
+	cancel()
+
+	select {
+	case _, ok := <-deliveries:
+		if ok {
+			t.Errorf("Unexpected delivery after the cancel")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Consumer not cancelled with its context")
+	}
+}
+
+func TestDeliveryAccessors(t *testing.T) {
+	srv, conn, ch := listen(t, "amqp://localhost:35715/%2f")
+	defer srv.Stop()
+	defer conn.Close()
+
+	q := declare(t, ch)
+	timestamp := time.Unix(1600000000, 0)
+
+	err := ch.Publish("", q.Name(), []byte("teste"), wabbit.Option{
+		"headers":         amqp.Table{"trace": "1"},
+		"contentType":     "application/json",
+		"contentEncoding": "gzip",
+		"deliveryMode":    amqp.Persistent,
+		"priority":        uint8(3),
+		"messageId":       "id-1",
+		"correlationId":   "correlation-1",
+		"replyTo":         "replies",
+		"expiration":      "60000",
+		"timestamp":       timestamp,
+		"type":            "event",
+		"userId":          "guest",
+		"appId":           "wabbit",
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	deliveries, err := ch.Consume(q.Name(), "consumer", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var d wabbit.Delivery
+
+	select {
+	case d = <-deliveries:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Message not delivered")
+		return
+	}
+
+	for _, tt := range []struct {
+		name          string
+		got, expected interface{}
+	}{
+		{"body", string(d.Body()), "teste"},
+		{"headers", d.Headers()["trace"], "1"},
+		{"delivery tag", d.DeliveryTag(), uint64(1)},
+		{"consumer tag", d.ConsumerTag(), "consumer"},
+		{"redelivered", d.Redelivered(), false},
+		{"exchange", d.Exchange(), ""},
+		{"routing key", d.RoutingKey(), q.Name()},
+		{"content type", d.ContentType(), "application/json"},
+		{"content encoding", d.ContentEncoding(), "gzip"},
+		{"delivery mode", d.DeliveryMode(), amqp.Persistent},
+		{"priority", d.Priority(), uint8(3)},
+		{"message id", d.MessageId(), "id-1"},
+		{"correlation id", d.CorrelationId(), "correlation-1"},
+		{"reply to", d.ReplyTo(), "replies"},
+		{"expiration", d.Expiration(), "60000"},
+		{"timestamp", d.Timestamp().Unix(), timestamp.Unix()},
+		{"type", d.Type(), "event"},
+		{"user id", d.UserId(), "guest"},
+		{"app id", d.AppId(), "wabbit"},
+		{"message count", d.MessageCount(), uint32(0)},
+	} {
+		if tt.got != tt.expected {
+			t.Errorf("Unexpected %s: %v, expected %v", tt.name, tt.got, tt.expected)
+		}
+	}
+
+	if err = d.Ack(false); err != nil {
+		t.Error(err)
+	}
+}
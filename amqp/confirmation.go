@@ -1,6 +1,10 @@
 package amqp
 
-import amqp "github.com/rabbitmq/amqp091-go"
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
 
 type Confirmation struct {
 	amqp.Confirmation
@@ -13,3 +17,17 @@ func (c Confirmation) Ack() bool {
 func (c Confirmation) DeliveryTag() uint64 {
 	return c.Confirmation.DeliveryTag
 }
+
+// DeferredConfirmation wraps the publisher confirmation of a single
+// message
+type DeferredConfirmation struct {
+	*amqp.DeferredConfirmation
+}
+
+func (d DeferredConfirmation) DeliveryTag() uint64 {
+	return d.DeferredConfirmation.DeliveryTag
+}
+
+func (d DeferredConfirmation) Wait(ctx context.Context) (bool, error) {
+	return d.DeferredConfirmation.WaitContext(ctx)
+}
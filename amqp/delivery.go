@@ -27,14 +27,66 @@ func (d *Delivery) ConsumerTag() string {
 	return d.Delivery.ConsumerTag
 }
 
+func (d *Delivery) Redelivered() bool {
+	return d.Delivery.Redelivered
+}
+
+func (d *Delivery) Exchange() string {
+	return d.Delivery.Exchange
+}
+
+func (d *Delivery) RoutingKey() string {
+	return d.Delivery.RoutingKey
+}
+
 func (d *Delivery) MessageId() string {
 	return d.Delivery.MessageId
 }
 
 func (d *Delivery) Timestamp() time.Time {
-	return time.Now()
+	return d.Delivery.Timestamp
 }
 
 func (d *Delivery) ContentType() string {
 	return d.Delivery.ContentType
 }
+
+func (d *Delivery) ContentEncoding() string {
+	return d.Delivery.ContentEncoding
+}
+
+func (d *Delivery) DeliveryMode() uint8 {
+	return d.Delivery.DeliveryMode
+}
+
+func (d *Delivery) Priority() uint8 {
+	return d.Delivery.Priority
+}
+
+func (d *Delivery) CorrelationId() string {
+	return d.Delivery.CorrelationId
+}
+
+func (d *Delivery) ReplyTo() string {
+	return d.Delivery.ReplyTo
+}
+
+func (d *Delivery) Expiration() string {
+	return d.Delivery.Expiration
+}
+
+func (d *Delivery) Type() string {
+	return d.Delivery.Type
+}
+
+func (d *Delivery) UserId() string {
+	return d.Delivery.UserId
+}
+
+func (d *Delivery) AppId() string {
+	return d.Delivery.AppId
+}
+
+func (d *Delivery) MessageCount() uint32 {
+	return d.Delivery.MessageCount
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"sync"
@@ -8,43 +10,86 @@ import (
 
 	"github.com/NeowayLabs/wabbit"
 	"github.com/NeowayLabs/wabbit/utils"
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 type (
 	Channel struct {
 		*VHost
 
+		// connID is the connection owning the channel, and the
+		// exclusive queues declared by it.
+		connID string
+
 		unacked    []unackData
 		muUnacked  *sync.RWMutex
-		consumers  map[string]consumer
+		consumers  map[string]*consumer
 		muConsumer *sync.RWMutex
 
+		// prefetch credit, see Qos
+		muQos          *sync.Mutex
+		prefetchCount  int // per consumer
+		prefetchGlobal int // shared by the consumers of the channel
+		inflight       int // unacked deliveries of the consumers
+
+		// deliveryTagCounter numbers the deliveries of the channel,
+		// either consumed or got.
 		_                  uint32
 		deliveryTagCounter uint64
 
-		confirm bool
+		// publishing serializes the publishes, then confirms are sent
+		// in the order of the publish sequence numbers. It's a
+		// semaphore instead of a mutex to abort the waiting publishes
+		// when their context is done.
+		publishing chan struct{}
+		confirm    bool
+		publishSeq uint64
+
+		// transaction, see Tx
+		muTx        *sync.Mutex
+		tx          bool
+		txPublishes []txPublish
+		txAcks      []txAck
 
 		publishListeners   []chan wabbit.Confirmation
 		muPublishListeners *sync.RWMutex
 
+		returnListeners   []chan wabbit.Return
+		muReturnListeners *sync.RWMutex
+
+		// returned, if set, is called with each return before the
+		// confirm of the message is sent. The wire listener writes
+		// basic.return with it, then always before basic.ack.
+		returned func(wabbit.Return)
+
+		// cancelled, if set, is called with the tag of each consumer
+		// cancelled by the server, like when its queue is deleted.
+		// The wire listener sends basic.cancel with it.
+		cancelled func(tag string)
+
+		// listenerRoom signals that a listener took a notification
+		// from its buffer, see waitListeners.
+		listenerRoom chan struct{}
+
 		errSpread *utils.ErrBroadcast
+
+		// closed is set by Close and by the channel exceptions, then
+		// the later calls fail.
+		muClose *sync.Mutex
+		closed  bool
 	}
 
 	unackData struct {
-		d wabbit.Delivery
+		d *Delivery
 		q *Queue
-	}
-
-	consumer struct {
-		tag        string
-		deliveries chan wabbit.Delivery
-		done       chan bool
+		c *consumer
 	}
 )
 
 var consumerSeq uint64
 
+// errClosed is returned by the calls on a closed channel
+var errClosed = utils.NewError(utils.ChannelError, "channel/connection is not open", false, false)
+
 func uniqueConsumerTag() string {
 	return fmt.Sprintf("ctag-%s-%d", os.Args[0], atomic.AddUint64(&consumerSeq, 1))
 }
@@ -55,24 +100,213 @@ func NewChannel(vhost *VHost) *Channel {
 		unacked:            make([]unackData, 0, QueueMaxLen),
 		muUnacked:          &sync.RWMutex{},
 		muConsumer:         &sync.RWMutex{},
-		consumers:          make(map[string]consumer),
+		consumers:          make(map[string]*consumer),
+		muQos:              &sync.Mutex{},
+		muTx:               &sync.Mutex{},
+		publishing:         make(chan struct{}, 1),
 		muPublishListeners: &sync.RWMutex{},
+		muReturnListeners:  &sync.RWMutex{},
+		listenerRoom:       make(chan struct{}, 1),
 		errSpread:          utils.NewErrBroadcast(),
+		muClose:            &sync.Mutex{},
 	}
 
 	return &c
 }
 
+// notOpen returns errClosed when the channel was closed
+func (ch *Channel) notOpen() error {
+	ch.muClose.Lock()
+	defer ch.muClose.Unlock()
+
+	if ch.closed {
+		return errClosed
+	}
+
+	return nil
+}
+
+// exception closes the channel when err is an AMQP exception, as the
+// broker does, and notifies the NotifyClose listeners. Other errors, like
+// invalid options, leave the channel open. It returns err.
+func (ch *Channel) exception(err error) error {
+	e, ok := err.(wabbit.Error)
+
+	if !ok || !e.Server() {
+		return err
+	}
+
+	if ch.shutdown() {
+		ch.errSpread.Write(e)
+	}
+
+	return err
+}
+
+func (ch *Channel) ExchangeDeclare(name, kind string, opt wabbit.Option) error {
+	if err := ch.notOpen(); err != nil {
+		return err
+	}
+
+	return ch.exception(ch.VHost.ExchangeDeclare(name, kind, opt))
+}
+
+func (ch *Channel) ExchangeDelete(name string, opt wabbit.Option) error {
+	if err := ch.notOpen(); err != nil {
+		return err
+	}
+
+	return ch.exception(ch.VHost.ExchangeDelete(name, opt))
+}
+
+func (ch *Channel) ExchangeDeclarePassive(name, kind string, opt wabbit.Option) error {
+	if err := ch.notOpen(); err != nil {
+		return err
+	}
+
+	return ch.exception(ch.VHost.ExchangeDeclarePassive(name, kind, opt))
+}
+
+// ExchangeDeclareWithContext declares the exchange unless ctx is done
+func (ch *Channel) ExchangeDeclareWithContext(ctx context.Context, name, kind string, opt wabbit.Option) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return ch.ExchangeDeclare(name, kind, opt)
+}
+
+// QueueDeclareWithContext declares the queue unless ctx is done
+func (ch *Channel) QueueDeclareWithContext(ctx context.Context, name string, args wabbit.Option) (wabbit.Queue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return ch.QueueDeclare(name, args)
+}
+
+// QueueDeclare declares the queue. Exclusive queues are owned by the
+// connection of the channel and locked to the other connections.
+func (ch *Channel) QueueDeclare(name string, args wabbit.Option) (wabbit.Queue, error) {
+	if err := ch.notOpen(); err != nil {
+		return nil, err
+	}
+
+	ch.VHost.mu.Lock()
+	q, err := ch.VHost.queueDeclare(name, false, args, ch.connID)
+	ch.VHost.mu.Unlock()
+
+	return q, ch.exception(err)
+}
+
+func (ch *Channel) QueueDeclarePassive(name string, args wabbit.Option) (wabbit.Queue, error) {
+	if err := ch.notOpen(); err != nil {
+		return nil, err
+	}
+
+	ch.VHost.mu.Lock()
+	q, err := ch.VHost.queueDeclare(name, true, args, ch.connID)
+	ch.VHost.mu.Unlock()
+
+	return q, ch.exception(err)
+}
+
+func (ch *Channel) QueueDelete(name string, args wabbit.Option) (int, error) {
+	if err := ch.notOpen(); err != nil {
+		return 0, err
+	}
+
+	ch.VHost.mu.Lock()
+	n, err := ch.VHost.queueDelete(name, args, ch.connID)
+	ch.VHost.mu.Unlock()
+
+	return n, ch.exception(err)
+}
+
+func (ch *Channel) QueuePurge(name string, opt wabbit.Option) (int, error) {
+	if err := ch.notOpen(); err != nil {
+		return 0, err
+	}
+
+	ch.VHost.mu.Lock()
+	n, err := ch.VHost.queuePurge(name, opt, ch.connID)
+	ch.VHost.mu.Unlock()
+
+	return n, ch.exception(err)
+}
+
+func (ch *Channel) QueueBind(name, key, exchange string, opt wabbit.Option) error {
+	if err := ch.notOpen(); err != nil {
+		return err
+	}
+
+	ch.VHost.mu.Lock()
+	err := ch.VHost.queueBind(name, key, exchange, opt, ch.connID)
+	ch.VHost.mu.Unlock()
+
+	return ch.exception(err)
+}
+
+func (ch *Channel) QueueUnbind(name, key, exchange string, opt wabbit.Option) error {
+	if err := ch.notOpen(); err != nil {
+		return err
+	}
+
+	ch.VHost.mu.Lock()
+	err := ch.VHost.queueUnbind(name, key, exchange, opt, ch.connID)
+	ch.VHost.mu.Unlock()
+
+	return ch.exception(err)
+}
+
+// QueueBindWithContext binds the route key to queue unless ctx is done
+func (ch *Channel) QueueBindWithContext(ctx context.Context, name, key, exchange string, opt wabbit.Option) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return ch.QueueBind(name, key, exchange, opt)
+}
+
+// QueueInspect returns the queue as a passive declare, without renewing
+// its x-expires lease.
 func (ch *Channel) QueueInspect(name string) (wabbit.Queue, error) {
+	if err := ch.notOpen(); err != nil {
+		return nil, err
+	}
+
+	ch.VHost.mu.Lock()
 	q, ok := ch.queues[name]
-	if ok {
-		return q, nil
+	ch.VHost.mu.Unlock()
+
+	if !ok {
+		return nil, ch.exception(utils.NewError(utils.NotFound,
+			fmt.Sprintf("NOT_FOUND - no queue '%s' in vhost '%s'", name, ch.name),
+			true, false))
 	}
-	return nil, fmt.Errorf("no queue named %s", name)
+
+	return q, nil
 }
 
 func (ch *Channel) Confirm(noWait bool) error {
-	ch.confirm = true
+	if err := ch.notOpen(); err != nil {
+		return err
+	}
+
+	ch.muTx.Lock()
+	tx := ch.tx
+
+	if !tx {
+		ch.confirm = true
+	}
+
+	ch.muTx.Unlock()
+
+	if tx {
+		return ch.exception(utils.NewError(utils.PreconditionFailed,
+			"PRECONDITION_FAILED - cannot switch from tx to confirm mode",
+			true, false))
+	}
 
 	return nil
 }
@@ -81,19 +315,27 @@ func (ch *Channel) NotifyPublish(confirm chan wabbit.Confirmation) chan wabbit.C
 	aux := make(chan wabbit.Confirmation, 2<<8)
 
 	ch.muPublishListeners.Lock()
+
+	if ch.notOpen() != nil {
+		ch.muPublishListeners.Unlock()
+		close(confirm)
+		return confirm
+	}
+
 	ch.publishListeners = append(ch.publishListeners, aux)
 	ch.muPublishListeners.Unlock()
 
-	// aux is set to the maximum size of a queue: 512.
+	// aux is buffered with 512 confirmations.
 	// In theory it is possible that a publisher could deliver >512 messages
-	// on a channel by sending to multiple queues, in which case Publish()
-	// will block trying to send confirmations. However this is a pathological
-	// case which can be ignored since there should be an attached listener
-	// on the other end of the confirm channel. In any case, a buffered queue,
-	// while seemingly inefficient is a good enough solution to make sure
-	// Publish() doesn't block.
+	// on a channel before the listener reads them, in which case Publish()
+	// will block waiting for room in the buffer. However this is a
+	// pathological case which can be ignored since there should be an
+	// attached listener on the other end of the confirm channel. In any
+	// case, a buffered queue, while seemingly inefficient is a good enough
+	// solution to make sure Publish() doesn't block.
 	go func() {
 		for c := range aux {
+			ch.freeListenerRoom()
 			confirm <- c
 		}
 		close(confirm)
@@ -102,116 +344,573 @@ func (ch *Channel) NotifyPublish(confirm chan wabbit.Confirmation) chan wabbit.C
 	return confirm
 }
 
+// NotifyReturn registers a listener for the messages published with the
+// mandatory option that couldn't be routed to any queue.
+func (ch *Channel) NotifyReturn(ret chan wabbit.Return) chan wabbit.Return {
+	aux := make(chan wabbit.Return, 2<<8)
+
+	ch.muReturnListeners.Lock()
+
+	if ch.notOpen() != nil {
+		ch.muReturnListeners.Unlock()
+		close(ret)
+		return ret
+	}
+
+	ch.returnListeners = append(ch.returnListeners, aux)
+	ch.muReturnListeners.Unlock()
+
+	// aux is buffered for the same reason of NotifyPublish
+	go func() {
+		for r := range aux {
+			ch.freeListenerRoom()
+			ret <- r
+		}
+		close(ret)
+	}()
+
+	return ret
+}
+
 func (ch *Channel) Publish(exc, route string, msg []byte, opt wabbit.Option) error {
-	hdrs, _ := opt["headers"].(amqp.Table)
-	messageId, _ := opt["messageId"].(string)
-	contentType, _ := opt["contentType"].(string)
-
-	d := NewDelivery(ch,
-		msg,
-		atomic.AddUint64(&ch.deliveryTagCounter, 1),
-		messageId,
-		wabbit.Option(hdrs),
-		contentType,
-	)
+	_, err := ch.publish(context.Background(), exc, route, msg, opt)
+	return ch.exception(err)
+}
+
+// PublishWithContext publishes the message, returning ctx.Err() when ctx
+// is done while the publish is blocked, waiting for the other publishes of
+// the channel or for the confirm and return listeners.
+func (ch *Channel) PublishWithContext(ctx context.Context, exc, route string, msg []byte, opt wabbit.Option) error {
+	_, err := ch.publish(ctx, exc, route, msg, opt)
+	return ch.exception(err)
+}
+
+// PublishWithDeferredConfirm publishes the message and returns its
+// publisher confirmation. It returns a nil confirmation when the channel
+// isn't in confirm mode.
+func (ch *Channel) PublishWithDeferredConfirm(exc, route string, msg []byte, opt wabbit.Option) (wabbit.DeferredConfirmation, error) {
+	dc, err := ch.publish(context.Background(), exc, route, msg, opt)
+
+	if err != nil || dc == nil {
+		return nil, ch.exception(err)
+	}
+
+	return dc, nil
+}
+
+func (ch *Channel) publish(ctx context.Context, exc, route string, msg []byte, opt wabbit.Option) (*DeferredConfirmation, error) {
+	var mandatory bool
+
+	if err := ch.notOpen(); err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if v, ok := opt["mandatory"]; ok {
+		mandatory, ok = v.(bool)
+
+		if !ok {
+			return nil, errors.New("mandatory option is of type bool")
+		}
+	}
 
-	err := ch.VHost.Publish(exc, route, d, nil)
+	props, err := utils.ConvertOpt(opt)
 
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	props.Body = msg
+
+	if props.Expiration != "" {
+		if _, ok := messageExpiration(props.Expiration); !ok {
+			return nil, utils.NewError(utils.PreconditionFailed,
+				fmt.Sprintf("PRECONDITION_FAILED - invalid expiration '%s'", props.Expiration),
+				true, false)
+		}
+	}
+
+	d := newPublishedDelivery(exc, route, props)
+
+	buffered, confirm := ch.bufferPublish(txPublish{exc, route, msg, opt, mandatory, d})
+
+	if buffered {
+		return nil, nil
+	}
+
+	select {
+	case ch.publishing <- struct{}{}:
+		defer func() { <-ch.publishing }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// once routed, the confirm and return of the message are always
+	// sent, then the context is done with before routing.
+	if err = ch.waitListeners(ctx, mandatory); err != nil {
+		return nil, err
+	}
+
+	var seq uint64
+
+	if confirm {
+		ch.publishSeq++
+		seq = ch.publishSeq
+	}
+
+	ch.VHost.mu.Lock()
+
+	var r routing
+
+	nack := confirm && ch.VHost.nackHook != nil && ch.VHost.nackHook(exc, route, msg)
+
+	if !nack {
+		r, err = ch.VHost.publish(exc, route, d, nil)
+	}
+
+	ch.VHost.mu.Unlock()
+
+	if err != nil {
+		// AMQP exceptions, like unknown exchanges, close the
+		// channel. Internal routing errors are nacked.
+		if _, ok := err.(wabbit.Error); ok || !confirm {
+			return nil, err
+		}
+
+		nack = true
+	}
+
+	if r.queues == 0 && mandatory && !nack {
+		ch.notifyReturn(wabbit.Return{
+			ReplyCode:  utils.NoRoute,
+			ReplyText:  "NO_ROUTE",
+			Exchange:   exc,
+			RoutingKey: route,
+			Body:       msg,
+			Properties: returnProperties(opt),
+		})
+	}
+
+	if !confirm {
+		return nil, nil
 	}
 
-	if ch.confirm {
-		confirm := Confirmation{ch.deliveryTagCounter, true}
-		for _, l := range ch.publishListeners {
-			l <- confirm
+	c := Confirmation{seq, !nack && r.rejected == 0}
+	ch.notifyPublish(c)
+
+	return newDeferredConfirmation(c), nil
+}
+
+// waitListeners blocks until the buffers of the confirm listeners, and
+// of the return listeners for mandatory publishes, have room for one
+// more notification, or until ctx is done. Must be called by the holder
+// of the publishing semaphore, the only sender of the notifications.
+func (ch *Channel) waitListeners(ctx context.Context, mandatory bool) error {
+	for !ch.listenersHaveRoom(mandatory) {
+		select {
+		case <-ch.listenerRoom:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 
 	return nil
 }
 
+func (ch *Channel) listenersHaveRoom(mandatory bool) bool {
+	ch.muPublishListeners.RLock()
+	defer ch.muPublishListeners.RUnlock()
+
+	for _, l := range ch.publishListeners {
+		if len(l) == cap(l) {
+			return false
+		}
+	}
+
+	if !mandatory {
+		return true
+	}
+
+	ch.muReturnListeners.RLock()
+	defer ch.muReturnListeners.RUnlock()
+
+	for _, l := range ch.returnListeners {
+		if len(l) == cap(l) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// freeListenerRoom wakes up the publish waiting for room in the buffers
+// of the listeners.
+func (ch *Channel) freeListenerRoom() {
+	select {
+	case ch.listenerRoom <- struct{}{}:
+	default:
+	}
+}
+
+// notifyPublish sends c to the confirm listeners
+func (ch *Channel) notifyPublish(c Confirmation) {
+	ch.muPublishListeners.RLock()
+	defer ch.muPublishListeners.RUnlock()
+
+	for _, l := range ch.publishListeners {
+		l <- c
+	}
+}
+
+// notifyReturn sends r to the return listeners
+func (ch *Channel) notifyReturn(r wabbit.Return) {
+	if ch.returned != nil {
+		ch.returned(r)
+	}
+
+	ch.muReturnListeners.RLock()
+	defer ch.muReturnListeners.RUnlock()
+
+	for _, l := range ch.returnListeners {
+		l <- r
+	}
+}
+
+// returnProperties returns the message properties of the publish options
+func returnProperties(opt wabbit.Option) wabbit.Option {
+	props := make(wabbit.Option, len(opt))
+
+	for k, v := range opt {
+		if k != "mandatory" {
+			props[k] = v
+		}
+	}
+
+	return props
+}
+
 // Consume starts a fake consumer of queue
 func (ch *Channel) Consume(queue, consumerName string, _ wabbit.Option) (<-chan wabbit.Delivery, error) {
-	var (
-		c consumer
-	)
+	c, err := ch.consume(queue, consumerName)
+
+	if err != nil {
+		return nil, ch.exception(err)
+	}
+
+	return c.deliveries, nil
+}
+
+// ConsumeWithContext starts a fake consumer of queue that is cancelled
+// when ctx is done.
+func (ch *Channel) ConsumeWithContext(ctx context.Context, queue, consumerName string, _ wabbit.Option) (<-chan wabbit.Delivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c, err := ch.consume(queue, consumerName)
+
+	if err != nil {
+		return nil, ch.exception(err)
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			ch.cancel(c)
+		case <-c.stopped:
+		}
+	}()
+
+	return c.deliveries, nil
+}
+
+func (ch *Channel) consume(queue, consumerName string) (*consumer, error) {
+	if err := ch.notOpen(); err != nil {
+		return nil, err
+	}
 
 	if consumerName == "" {
 		consumerName = uniqueConsumerTag()
 	}
 
-	c = consumer{
-		tag:        consumerName,
-		deliveries: make(chan wabbit.Delivery),
-		done:       make(chan bool),
+	ch.VHost.mu.Lock()
+	q, ok := ch.queues[queue]
+
+	if !ok {
+		ch.VHost.mu.Unlock()
+		return nil, utils.NewError(utils.NotFound,
+			fmt.Sprintf("NOT_FOUND - no queue '%s' in vhost '%s'", queue, ch.name),
+			true, false)
+	}
+
+	err := ch.VHost.locked(q, ch.connID)
+	ch.VHost.mu.Unlock()
+
+	if err != nil {
+		return nil, err
 	}
 
-	ch.muConsumer.RLock()
+	ch.muQos.Lock()
+	c := newConsumer(ch, q, consumerName, ch.prefetchCount)
+	ch.muQos.Unlock()
+
+	ch.muConsumer.Lock()
 
 	if c2, found := ch.consumers[consumerName]; found {
-		c2.done <- true
+		c2.stop()
 	}
 
 	ch.consumers[consumerName] = c
 
-	ch.muConsumer.RUnlock()
+	ch.muConsumer.Unlock()
+
+	go c.run()
+	q.subscribe(c)
+
+	return c, nil
+}
 
+// Get pops a single message from the queue. The bool result is false
+// when the queue is empty. Unless the autoAck option is set, the message
+// must be acked as the consumed ones.
+func (ch *Channel) Get(queue string, opt wabbit.Option) (wabbit.Delivery, bool, error) {
+	var autoAck bool
+
+	if err := ch.notOpen(); err != nil {
+		return nil, false, err
+	}
+
+	if v, ok := opt["autoAck"]; ok {
+		autoAck, ok = v.(bool)
+
+		if !ok {
+			return nil, false, errors.New("autoAck option is of type bool")
+		}
+	}
+
+	ch.VHost.mu.Lock()
 	q, ok := ch.queues[queue]
+	ch.VHost.mu.Unlock()
 
 	if !ok {
-		return nil, fmt.Errorf("Unknown queue '%s'", queue)
+		return nil, false, ch.exception(utils.NewError(utils.NotFound,
+			fmt.Sprintf("NOT_FOUND - no queue '%s' in vhost '%s'", queue, ch.name),
+			true, false))
 	}
 
-	go func() {
-		for {
-			select {
-			case <-c.done:
-				close(c.deliveries)
-				return
-			case d := <-q.data:
-				// since we keep track of unacked messages for
-				// the channel, we need to rebind the delivery
-				// to the consumer channel.
-				d = NewDelivery(ch, d.Body(), d.DeliveryTag(), d.MessageId(), d.Headers(), d.ContentType())
-
-				ch.addUnacked(d, q)
-
-				// sub-select required for cases when
-				// client attempts to close the channel
-				// concurrently with re-enqueues of messages
-				select {
-				case c.deliveries <- d:
-				case <-c.done:
-					close(c.deliveries)
-					return
-				}
-			}
-		}
-	}()
+	if err := ch.VHost.locked(q, ch.connID); err != nil {
+		return nil, false, ch.exception(err)
+	}
 
-	return c.deliveries, nil
+	d, remaining, ok := q.get()
+
+	if !ok {
+		return nil, false, nil
+	}
+
+	delivery := bindDelivery(ch, ch.nextDeliveryTag(), d)
+	delivery.messageCount = uint32(remaining)
+
+	if !autoAck {
+		ch.addUnacked(delivery, q, nil)
+	}
+
+	return delivery, true, nil
+}
+
+// Qos limits the unacked deliveries of each consumer started after the
+// call, or of all consumers of the channel when global is true. Zero
+// means no limit. As in RabbitMQ, prefetchSize isn't supported.
+func (ch *Channel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	if err := ch.notOpen(); err != nil {
+		return err
+	}
+
+	if prefetchSize != 0 {
+		return ch.exception(utils.NewError(utils.NotImplemented,
+			fmt.Sprintf("NOT_IMPLEMENTED - prefetch_size!=0 (%d)", prefetchSize),
+			true, false))
+	}
+
+	ch.muQos.Lock()
+
+	if global {
+		ch.prefetchGlobal = prefetchCount
+	} else {
+		ch.prefetchCount = prefetchCount
+	}
+
+	ch.muQos.Unlock()
+
+	ch.resume()
+	return nil
+}
+
+// acquire takes a prefetch credit for a delivery to c
+func (ch *Channel) acquire(c *consumer) bool {
+	ch.muQos.Lock()
+	defer ch.muQos.Unlock()
+
+	if (c.prefetch > 0 && c.unacked >= c.prefetch) ||
+		(ch.prefetchGlobal > 0 && ch.inflight >= ch.prefetchGlobal) {
+		return false
+	}
+
+	c.unacked++
+	ch.inflight++
+
+	return true
+}
+
+// release gives back the prefetch credit of a delivery to c
+func (ch *Channel) release(c *consumer) {
+	if c == nil {
+		return
+	}
+
+	ch.muQos.Lock()
+	defer ch.muQos.Unlock()
+
+	if c.unacked > 0 {
+		c.unacked--
+	}
+
+	if ch.inflight > 0 {
+		ch.inflight--
+	}
+}
+
+// resume dispatches to the consumers of the channel the messages held
+// back by the prefetch limits.
+func (ch *Channel) resume() {
+	ch.muConsumer.RLock()
+	queues := make([]*Queue, 0, len(ch.consumers))
+
+	for _, c := range ch.consumers {
+		queues = append(queues, c.queue)
+	}
+
+	ch.muConsumer.RUnlock()
+
+	for _, q := range queues {
+		q.resume()
+	}
 }
 
-func (ch *Channel) addUnacked(d wabbit.Delivery, q *Queue) {
+// nextDeliveryTag returns the tag of a new delivery of the channel
+func (ch *Channel) nextDeliveryTag() uint64 {
+	return atomic.AddUint64(&ch.deliveryTagCounter, 1)
+}
+
+func (ch *Channel) addUnacked(d *Delivery, q *Queue, c *consumer) {
 	ch.muUnacked.Lock()
 	defer ch.muUnacked.Unlock()
 
-	ch.unacked = append(ch.unacked, unackData{d, q})
+	ch.unacked = append(ch.unacked, unackData{d, q, c})
 }
 
-func (ch *Channel) enqueueUnacked() {
+// hasUnacked reports if the delivery tag, or any tag up to it when
+// multiple is set, is unacked. The tag zero with multiple means every
+// unacked delivery.
+func (ch *Channel) hasUnacked(tag uint64, multiple bool) bool {
+	if multiple && tag == 0 {
+		return true
+	}
+
+	ch.muUnacked.RLock()
+	defer ch.muUnacked.RUnlock()
+
+	for _, ud := range ch.unacked {
+		if udTag := ud.d.DeliveryTag(); udTag == tag || (multiple && udTag <= tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// takeUnacked removes and returns the unacked deliveries up to tag, the
+// ones of a multiple ack. The tag zero means every unacked delivery.
+func (ch *Channel) takeUnacked(tag uint64) []unackData {
 	ch.muUnacked.Lock()
 	defer ch.muUnacked.Unlock()
 
+	var taken []unackData
+
+	kept := ch.unacked[:0]
+
 	for _, ud := range ch.unacked {
-		ud.q.data <- ud.d
+		if tag == 0 || ud.d.DeliveryTag() <= tag {
+			taken = append(taken, ud)
+		} else {
+			kept = append(kept, ud)
+		}
 	}
 
+	for i := len(kept); i < len(ch.unacked); i++ {
+		ch.unacked[i] = unackData{}
+	}
+
+	ch.unacked = kept
+
+	return taken
+}
+
+// requeueUnacked requeues the unacked deliveries to the head of their
+// queues, keeping their order, in a single batch per queue.
+func requeueUnacked(unacked []unackData) {
+	batches := make(map[*Queue][]wabbit.Delivery)
+
+	for _, ud := range unacked {
+		batches[ud.q] = append(batches[ud.q], ud.d.redelivery())
+	}
+
+	for q, batch := range batches {
+		q.requeue(batch)
+	}
+}
+
+// dropUnacked forgets an unacked delivery without giving back its credit
+func (ch *Channel) dropUnacked(tag uint64) {
+	ch.muUnacked.Lock()
+	defer ch.muUnacked.Unlock()
+
+	for pos, ud := range ch.unacked {
+		if ud.d.DeliveryTag() == tag {
+			ch.unacked = ch.unacked[:pos+copy(ch.unacked[pos:], ch.unacked[pos+1:])]
+			return
+		}
+	}
+}
+
+func (ch *Channel) enqueueUnacked() {
+	ch.muUnacked.Lock()
+	defer ch.muUnacked.Unlock()
+
+	requeueUnacked(ch.unacked)
 	ch.unacked = make([]unackData, 0, QueueMaxLen)
+
+	ch.muQos.Lock()
+	ch.inflight = 0
+	ch.muQos.Unlock()
 }
 
 func (ch *Channel) Ack(tag uint64, multiple bool) error {
+	if err := ch.notOpen(); err != nil {
+		return err
+	}
+
+	if buffered, err := ch.bufferAck(txAck{tag: tag, multiple: multiple, ack: true}); buffered {
+		return ch.exception(err)
+	}
+
+	return ch.exception(ch.ack(tag, multiple))
+}
+
+func (ch *Channel) ack(tag uint64, multiple bool) error {
 	var (
 		pos int
 		ud  unackData
@@ -219,7 +918,6 @@ func (ch *Channel) Ack(tag uint64, multiple bool) error {
 
 	if !multiple {
 		ch.muUnacked.Lock()
-		defer ch.muUnacked.Unlock()
 
 		found := false
 		for pos, ud = range ch.unacked {
@@ -230,40 +928,45 @@ func (ch *Channel) Ack(tag uint64, multiple bool) error {
 		}
 
 		if !found {
-			return fmt.Errorf("Delivery tag %d not found", tag)
+			ch.muUnacked.Unlock()
+			return unknownDeliveryTag(tag)
 		}
 
 		ch.unacked = ch.unacked[:pos+copy(ch.unacked[pos:], ch.unacked[pos+1:])]
-	} else {
-		ackMessages := make([]uint64, 0, QueueMaxLen)
-
-		ch.muUnacked.Lock()
+		ch.muUnacked.Unlock()
 
-		found := false
-		for _, ud = range ch.unacked {
-			udTag := ud.d.DeliveryTag()
+		ch.release(ud.c)
+		ch.resume()
+	} else {
+		acked := ch.takeUnacked(tag)
 
-			if udTag <= tag {
-				found = true
-				ackMessages = append(ackMessages, udTag)
-			}
+		if len(acked) == 0 && tag != 0 {
+			return unknownDeliveryTag(tag)
 		}
 
-		ch.muUnacked.Unlock()
-
-		if !found {
-			return fmt.Errorf("Delivery tag %d not found", tag)
+		for _, ud = range acked {
+			ch.release(ud.c)
 		}
 
-		for _, udTag := range ackMessages {
-			ch.Ack(udTag, false)
-		}
+		ch.resume()
 	}
 
 	return nil
 }
 
 func (ch *Channel) Nack(tag uint64, multiple bool, requeue bool) error {
+	if err := ch.notOpen(); err != nil {
+		return err
+	}
+
+	if buffered, err := ch.bufferAck(txAck{tag: tag, multiple: multiple, requeue: requeue}); buffered {
+		return ch.exception(err)
+	}
+
+	return ch.exception(ch.nack(tag, multiple, requeue))
+}
+
+func (ch *Channel) nack(tag uint64, multiple bool, requeue bool) error {
 	var (
 		pos int
 		ud  unackData
@@ -271,7 +974,6 @@ func (ch *Channel) Nack(tag uint64, multiple bool, requeue bool) error {
 
 	if !multiple {
 		ch.muUnacked.Lock()
-		defer ch.muUnacked.Unlock()
 		found := false
 		for pos, ud = range ch.unacked {
 			if ud.d.DeliveryTag() == tag {
@@ -281,28 +983,42 @@ func (ch *Channel) Nack(tag uint64, multiple bool, requeue bool) error {
 		}
 
 		if !found {
-			return fmt.Errorf("Delivery tag %d not found", tag)
+			ch.muUnacked.Unlock()
+			return unknownDeliveryTag(tag)
 		}
 
+		ch.unacked = ch.unacked[:pos+copy(ch.unacked[pos:], ch.unacked[pos+1:])]
+		ch.muUnacked.Unlock()
+
+		ch.release(ud.c)
+
 		if requeue {
-			ud.q.data <- ud.d
+			ud.q.requeue([]wabbit.Delivery{ud.d.redelivery()})
+		} else {
+			ch.VHost.reject(ud.q, ud.d)
 		}
 
-		ch.unacked = ch.unacked[:pos+copy(ch.unacked[pos:], ch.unacked[pos+1:])]
+		ch.resume()
 	} else {
-		nackMessages := make([]uint64, 0, QueueMaxLen)
+		nacked := ch.takeUnacked(tag)
 
-		for _, ud = range ch.unacked {
-			udTag := ud.d.DeliveryTag()
+		if len(nacked) == 0 && tag != 0 {
+			return unknownDeliveryTag(tag)
+		}
 
-			if udTag <= tag {
-				nackMessages = append(nackMessages, udTag)
-			}
+		for _, ud = range nacked {
+			ch.release(ud.c)
 		}
 
-		for _, udTag := range nackMessages {
-			ch.Nack(udTag, false, requeue)
+		if requeue {
+			requeueUnacked(nacked)
+		} else {
+			for _, ud = range nacked {
+				ch.VHost.reject(ud.q, ud.d)
+			}
 		}
+
+		ch.resume()
 	}
 
 	return nil
@@ -312,15 +1028,66 @@ func (ch *Channel) Reject(tag uint64, requeue bool) error {
 	return ch.Nack(tag, false, requeue)
 }
 
+// Recover requeues the unacked messages of the channel, then they are
+// redelivered. Recovering without requeue isn't supported, as in
+// RabbitMQ.
+func (ch *Channel) Recover(requeue bool) error {
+	if err := ch.notOpen(); err != nil {
+		return err
+	}
+
+	if !requeue {
+		return ch.exception(utils.NewError(utils.NotImplemented,
+			"NOT_IMPLEMENTED - requeue=false",
+			true, false))
+	}
+
+	unacked := ch.takeUnacked(0)
+
+	for _, ud := range unacked {
+		ch.release(ud.c)
+	}
+
+	requeueUnacked(unacked)
+	ch.resume()
+
+	return nil
+}
+
+// unknownDeliveryTag returns the exception of acking a delivery tag that
+// isn't unacked in the channel.
+func unknownDeliveryTag(tag uint64) error {
+	return utils.NewError(utils.PreconditionFailed,
+		fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", tag),
+		true, false)
+}
+
+// Close stops the consumers of the channel and requeues its unacked
+// messages. Closing a closed channel is a no-op.
 func (ch *Channel) Close() error {
+	ch.shutdown()
+	return nil
+}
+
+// shutdown closes the channel and reports if it was open
+func (ch *Channel) shutdown() bool {
+	ch.muClose.Lock()
+	closed := ch.closed
+	ch.closed = true
+	ch.muClose.Unlock()
+
+	if closed {
+		return false
+	}
+
 	ch.muConsumer.Lock()
 	defer ch.muConsumer.Unlock()
 
 	for _, consumer := range ch.consumers {
-		consumer.done <- true
+		consumer.stop()
 	}
 
-	ch.consumers = make(map[string]consumer)
+	ch.consumers = make(map[string]*consumer)
 
 	// enqueue shall happens only after every consumer of this channel
 	// has stopped.
@@ -333,17 +1100,80 @@ func (ch *Channel) Close() error {
 	}
 	ch.publishListeners = []chan wabbit.Confirmation{}
 
-	return nil
+	ch.muTx.Lock()
+	ch.txPublishes, ch.txAcks = nil, nil
+	ch.muTx.Unlock()
+
+	ch.muReturnListeners.Lock()
+	defer ch.muReturnListeners.Unlock()
+	for _, c := range ch.returnListeners {
+		close(c)
+	}
+	ch.returnListeners = []chan wabbit.Return{}
+
+	// a publish waiting for room sees the listeners are gone
+	ch.freeListenerRoom()
+
+	return true
 }
 
-// NotifyClose publishs notifications about errors in the given channel
+// NotifyClose publishs notifications about errors in the given channel,
+// like the channel exceptions. It's closed at once if the channel is
+// already closed.
 func (ch *Channel) NotifyClose(c chan wabbit.Error) chan wabbit.Error {
+	if ch.notOpen() != nil {
+		close(c)
+		return c
+	}
+
 	ch.errSpread.Add(c)
 	return c
 }
 
-// Cancel closes deliveries for all consumers
+// Cancel stops the named consumer and closes its deliveries. The
+// messages delivered to it and not acked yet remain owned by the channel.
+// Cancelling an unknown consumer is a no-op.
 func (ch *Channel) Cancel(consumer string, noWait bool) error {
-	ch.Close()
+	if err := ch.notOpen(); err != nil {
+		return err
+	}
+
+	ch.muConsumer.Lock()
+	defer ch.muConsumer.Unlock()
+
+	if c, found := ch.consumers[consumer]; found {
+		c.stop()
+		delete(ch.consumers, consumer)
+	}
+
 	return nil
 }
+
+// serverCancel forgets c, stopped by the server, and notifies the
+// cancellation unless c was cancelled meanwhile.
+func (ch *Channel) serverCancel(c *consumer) {
+	ch.muConsumer.Lock()
+	found := ch.consumers[c.tag] == c
+
+	if found {
+		delete(ch.consumers, c.tag)
+	}
+
+	ch.muConsumer.Unlock()
+
+	if found && ch.cancelled != nil {
+		ch.cancelled(c.tag)
+	}
+}
+
+// cancel stops c unless it was already stopped or replaced by another
+// consumer with the same tag.
+func (ch *Channel) cancel(c *consumer) {
+	ch.muConsumer.Lock()
+	defer ch.muConsumer.Unlock()
+
+	if ch.consumers[c.tag] == c {
+		c.stop()
+		delete(ch.consumers, c.tag)
+	}
+}
@@ -1,8 +1,13 @@
 package server
 
 import (
+	"context"
 	"testing"
 	"time"
+
+	"github.com/NeowayLabs/wabbit"
+	"github.com/NeowayLabs/wabbit/utils"
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 func TestBasicConsumer(t *testing.T) {
@@ -885,3 +890,1063 @@ func TestRejectedMessagesAreRejectedWhenRequested(t *testing.T) {
 	case <-timer:
 	}
 }
+
+func TestQueueIsUnbounded(t *testing.T) {
+	vh := NewVHost("/")
+
+	ch := NewChannel(vh)
+
+	q, err := ch.QueueDeclare("data-queue", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	total := QueueMaxLen * 2
+
+	for i := 0; i < total; i++ {
+		err = ch.Publish("", q.Name(), []byte("teste"), nil)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	inspect, err := ch.QueueInspect(q.Name())
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if inspect.Messages() != total || inspect.Consumers() != 0 {
+		t.Errorf("Invalid queue counts: %d messages, %d consumers", inspect.Messages(), inspect.Consumers())
+		return
+	}
+
+	deliveries, err := ch.Consume(q.Name(), "tag-teste", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i := 0; i < total; i++ {
+		select {
+		case <-deliveries:
+		case <-time.After(5 * time.Second):
+			t.Errorf("Received only %d of %d messages", i, total)
+			return
+		}
+	}
+
+	passive, err := ch.QueueDeclarePassive(q.Name(), nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if passive.Messages() != 0 || passive.Consumers() != 1 {
+		t.Errorf("Invalid queue counts: %d messages, %d consumers", passive.Messages(), passive.Consumers())
+		return
+	}
+
+	ch.Close()
+
+	if q.Messages() != total || q.Consumers() != 0 {
+		t.Errorf("Unacked messages not requeued on close: %d messages, %d consumers", q.Messages(), q.Consumers())
+	}
+}
+
+func TestCancelStopsOnlyTheNamedConsumer(t *testing.T) {
+	vh := NewVHost("/")
+
+	ch := NewChannel(vh)
+
+	for _, name := range []string{"queue-a", "queue-b"} {
+		if _, err := ch.QueueDeclare(name, nil); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	deliveriesA, err := ch.Consume("queue-a", "consumer-a", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	deliveriesB, err := ch.Consume("queue-b", "consumer-b", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ch.Publish("", "queue-a", []byte("teste"), nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	inFlight := <-deliveriesA
+
+	err = ch.Cancel("consumer-a", false)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, ok := <-deliveriesA; ok {
+		t.Errorf("Deliveries of the cancelled consumer shall be closed")
+		return
+	}
+
+	err = ch.Publish("", "queue-b", []byte("teste"), nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case <-deliveriesB:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Consumer not cancelled stopped receiving messages")
+		return
+	}
+
+	if q := vh.queues["queue-a"]; q.Messages() != 0 || q.Consumers() != 0 {
+		t.Errorf("In-flight message requeued on cancel: %d messages, %d consumers", q.Messages(), q.Consumers())
+		return
+	}
+
+	if err = inFlight.Ack(false); err != nil {
+		t.Errorf("In-flight message of the cancelled consumer shall be owned by the channel: %s", err)
+	}
+}
+
+func TestQosPrefetchPerConsumer(t *testing.T) {
+	vh := NewVHost("/")
+
+	ch := NewChannel(vh)
+
+	q, err := ch.QueueDeclare("data-queue", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ch.Qos(1, 0, false)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	deliveriesA, err := ch.Consume(q.Name(), "consumer-a", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	deliveriesB, err := ch.Consume(q.Name(), "consumer-b", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, body := range []string{"1", "2", "3", "4"} {
+		if err = ch.Publish("", q.Name(), []byte(body), nil); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	a := <-deliveriesA
+	b := <-deliveriesB
+
+	if string(a.Body()) != "1" || string(b.Body()) != "2" {
+		t.Errorf("Messages not dispatched in round-robin: %s %s", a.Body(), b.Body())
+		return
+	}
+
+	select {
+	case d := <-deliveriesA:
+		t.Errorf("Consumer received %s beyond its prefetch", d.Body())
+		return
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if q.Messages() != 2 {
+		t.Errorf("Messages beyond the prefetch shall stay in the queue: %d", q.Messages())
+		return
+	}
+
+	if err = a.Ack(false); err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case d := <-deliveriesA:
+		if string(d.Body()) != "3" {
+			t.Errorf("Unexpected message after ack: %s", d.Body())
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Delivery not resumed after ack")
+	}
+}
+
+func TestQosPrefetchGlobal(t *testing.T) {
+	vh := NewVHost("/")
+
+	ch := NewChannel(vh)
+
+	deliveries := make([]<-chan wabbit.Delivery, 0, 2)
+
+	err := ch.Qos(1, 0, true)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, name := range []string{"queue-a", "queue-b"} {
+		if _, err = ch.QueueDeclare(name, nil); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if err = ch.Publish("", name, []byte(name), nil); err != nil {
+			t.Error(err)
+			return
+		}
+
+		d, err := ch.Consume(name, "", nil)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		deliveries = append(deliveries, d)
+	}
+
+	first := <-deliveries[0]
+
+	select {
+	case d := <-deliveries[1]:
+		t.Errorf("Channel received %s beyond its global prefetch", d.Body())
+		return
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err = first.Ack(false); err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case <-deliveries[1]:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Delivery not resumed after ack")
+	}
+
+	if err = ch.Qos(1, 1024, false); err == nil {
+		t.Errorf("prefetchSize shall not be supported")
+	}
+}
+
+func TestGet(t *testing.T) {
+	vh := NewVHost("/")
+
+	ch := NewChannel(vh)
+
+	q, err := ch.QueueDeclare("data-queue", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, ok, err := ch.Get(q.Name(), nil)
+
+	if err != nil || ok {
+		t.Errorf("Get of empty queue shall return no message: %v %v", ok, err)
+		return
+	}
+
+	for _, body := range []string{"1", "2", "3"} {
+		if err = ch.Publish("", q.Name(), []byte(body), nil); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	d, ok, err := ch.Get(q.Name(), nil)
+
+	if err != nil || !ok {
+		t.Errorf("Get failed: %v %v", ok, err)
+		return
+	}
+
+	if string(d.Body()) != "1" || d.MessageCount() != 2 {
+		t.Errorf("Unexpected message %s with %d remaining", d.Body(), d.MessageCount())
+		return
+	}
+
+	if err = d.Nack(false, true); err != nil {
+		t.Errorf("Message got without autoAck shall be unacked: %s", err)
+		return
+	}
+
+	d, ok, err = ch.Get(q.Name(), wabbit.Option{"autoAck": true})
+
+	if err != nil || !ok {
+		t.Errorf("Get failed: %v %v", ok, err)
+		return
+	}
+
+	if err = d.Ack(false); err == nil {
+		t.Errorf("Message got with autoAck shall not be unacked")
+		return
+	}
+
+	if q.Messages() != 2 {
+		t.Errorf("Invalid number of messages remaining: %d", q.Messages())
+		return
+	}
+
+	if _, _, err = ch.Get("unknown-queue", nil); err == nil {
+		t.Errorf("Get of unknown queue shall fail")
+	}
+}
+
+func TestPublishMandatoryReturnsUnroutable(t *testing.T) {
+	vh := NewVHost("/")
+
+	ch := NewChannel(vh)
+
+	returns := ch.NotifyReturn(make(chan wabbit.Return, 1))
+
+	err := ch.ExchangeDeclare("neoway", "direct", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ch.Publish("neoway", "unbound", []byte("dropped"), nil)
+
+	if err != nil {
+		t.Errorf("Unroutable message shall be dropped silently: %s", err)
+		return
+	}
+
+	err = ch.Publish("neoway", "unbound", []byte("teste"), wabbit.Option{
+		"mandatory":   true,
+		"contentType": "text/plain",
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case r := <-returns:
+		if r.ReplyCode != 312 || r.ReplyText != "NO_ROUTE" ||
+			r.Exchange != "neoway" || r.RoutingKey != "unbound" ||
+			string(r.Body) != "teste" || r.Properties["contentType"] != "text/plain" {
+			t.Errorf("Invalid return: %+v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Mandatory message not returned")
+		return
+	}
+
+	ch.Close()
+
+	if _, ok := <-returns; ok {
+		t.Errorf("Return listener shall be closed with the channel")
+	}
+}
+
+func TestPublishConfirmsInOrder(t *testing.T) {
+	vh := NewVHost("/")
+
+	ch := NewChannel(vh)
+
+	q, err := ch.QueueDeclare("data-queue", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ch.Confirm(false); err != nil {
+		t.Error(err)
+		return
+	}
+
+	confirms := ch.NotifyPublish(make(chan wabbit.Confirmation, 100))
+
+	const publishers, messages = 4, 25
+
+	done := make(chan error, publishers)
+
+	for i := 0; i < publishers; i++ {
+		go func() {
+			for j := 0; j < messages; j++ {
+				if err := ch.Publish("", q.Name(), []byte("teste"), nil); err != nil {
+					done <- err
+					return
+				}
+			}
+
+			done <- nil
+		}()
+	}
+
+	for i := 0; i < publishers; i++ {
+		if err = <-done; err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	for tag := uint64(1); tag <= publishers*messages; tag++ {
+		c := <-confirms
+
+		if c.DeliveryTag() != tag || !c.Ack() {
+			t.Errorf("Expected ack of tag %d, got %d (ack: %v)", tag, c.DeliveryTag(), c.Ack())
+			return
+		}
+	}
+}
+
+func TestPublishConfirmNacks(t *testing.T) {
+	vh := NewVHost("/")
+
+	ch := NewChannel(vh)
+
+	_, err := ch.QueueDeclare("retry", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ch.Confirm(false); err != nil {
+		t.Error(err)
+		return
+	}
+
+	confirms := ch.NotifyPublish(make(chan wabbit.Confirmation, 2))
+
+	vh.NackPublishes(func(exchange, key string, body []byte) bool {
+		return string(body) == "nack me"
+	})
+
+	for _, p := range []struct {
+		exc, key, body string
+	}{
+		{"", "retry", "nack me"},
+		{"", "retry", "teste"},
+	} {
+		if err = ch.Publish(p.exc, p.key, []byte(p.body), nil); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	for _, expected := range []bool{false, true} {
+		if c := <-confirms; c.Ack() != expected {
+			t.Errorf("Unexpected confirm of tag %d: %v", c.DeliveryTag(), c.Ack())
+			return
+		}
+	}
+
+	if n := vh.queues["retry"].Messages(); n != 1 {
+		t.Errorf("Nacked message by the hook shall not be routed: %d", n)
+	}
+}
+
+func TestPublishWithDeferredConfirm(t *testing.T) {
+	vh := NewVHost("/")
+
+	ch := NewChannel(vh)
+
+	q, err := ch.QueueDeclare("data-queue", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dc, err := ch.PublishWithDeferredConfirm("", q.Name(), []byte("teste"), nil)
+
+	if err != nil || dc != nil {
+		t.Errorf("Expected no confirmation without confirm mode: %v %v", dc, err)
+		return
+	}
+
+	if err = ch.Confirm(false); err != nil {
+		t.Error(err)
+		return
+	}
+
+	vh.NackPublishes(func(_, _ string, body []byte) bool {
+		return string(body) == "nack me"
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i, p := range []struct {
+		body  string
+		acked bool
+	}{
+		{"teste", true},
+		{"nack me", false},
+	} {
+		dc, err = ch.PublishWithDeferredConfirm("", q.Name(), []byte(p.body), nil)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		acked, err := dc.Wait(ctx)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		select {
+		case <-dc.Done():
+		default:
+			t.Errorf("Confirmation shall be done after Wait")
+			return
+		}
+
+		if acked != p.acked || dc.Acked() != p.acked || dc.DeliveryTag() != uint64(i+1) {
+			t.Errorf("Unexpected confirmation of %s: tag %d, acked %v", p.body, dc.DeliveryTag(), acked)
+			return
+		}
+	}
+}
+
+func TestPublishWithContext(t *testing.T) {
+	vh := NewVHost("/")
+
+	ch := NewChannel(vh)
+
+	q, err := ch.QueueDeclare("data-queue", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ch.Confirm(false); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// nobody reads the confirmations for now
+	confirms := ch.NotifyPublish(make(chan wabbit.Confirmation))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// the listener buffers, then the publish blocks
+	for i := 0; i < QueueMaxLen+1; i++ {
+		if err = ch.PublishWithContext(ctx, "", q.Name(), []byte("teste"), nil); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	err = ch.PublishWithContext(ctx, "", q.Name(), []byte("teste"), nil)
+
+	if err != context.DeadlineExceeded {
+		t.Errorf("Blocked publish shall abort with the context: %v", err)
+		return
+	}
+
+	// the aborted publish wasn't routed
+	if q.Messages() != QueueMaxLen+1 {
+		t.Errorf("Unexpected messages in the queue: %d", q.Messages())
+		return
+	}
+
+	err = ch.PublishWithContext(ctx, "", q.Name(), []byte("teste"), nil)
+
+	if err != context.DeadlineExceeded {
+		t.Errorf("Publish with a done context shall fail: %v", err)
+		return
+	}
+
+	for i := 1; i <= QueueMaxLen+1; i++ {
+		if c := <-confirms; c.DeliveryTag() != uint64(i) {
+			t.Errorf("Expected confirm %d, got %d", i, c.DeliveryTag())
+			return
+		}
+	}
+
+	if err = ch.Publish("", q.Name(), []byte("teste"), nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if c := <-confirms; c.DeliveryTag() != QueueMaxLen+2 {
+		t.Errorf("Gap in the confirms after the aborted publishes: %d", c.DeliveryTag())
+	}
+}
+
+func TestWithContextCancelled(t *testing.T) {
+	vh := NewVHost("/")
+
+	ch := NewChannel(vh)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := ch.ExchangeDeclareWithContext(ctx, "topic-exchange", "topic", nil); err != context.Canceled {
+		t.Errorf("ExchangeDeclare shall fail with the context: %v", err)
+		return
+	}
+
+	if _, err := ch.QueueDeclareWithContext(ctx, "data-queue", nil); err != context.Canceled {
+		t.Errorf("QueueDeclare shall fail with the context: %v", err)
+		return
+	}
+
+	if _, err := ch.QueueInspect("data-queue"); err == nil {
+		t.Errorf("Queue declared with a cancelled context")
+		return
+	}
+
+	// closed by the NOT_FOUND exception
+	ch = NewChannel(vh)
+
+	q, err := ch.QueueDeclareWithContext(context.Background(), "data-queue", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ch.QueueBindWithContext(ctx, q.Name(), "#", "amq.topic", nil); err != context.Canceled {
+		t.Errorf("QueueBind shall fail with the context: %v", err)
+		return
+	}
+
+	if _, err = ch.ConsumeWithContext(ctx, q.Name(), "", nil); err != context.Canceled {
+		t.Errorf("Consume shall fail with the context: %v", err)
+		return
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	deliveries, err := ch.ConsumeWithContext(ctx, q.Name(), "consumer", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cancel()
+
+	select {
+	case _, ok := <-deliveries:
+		if ok {
+			t.Errorf("Unexpected delivery")
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Consumer not cancelled with its context")
+		return
+	}
+
+	if q.Consumers() != 0 {
+		t.Errorf("Cancelled consumer still subscribed: %d", q.Consumers())
+	}
+}
+
+func TestDeliveryProperties(t *testing.T) {
+	vh := NewVHost("/")
+
+	ch := NewChannel(vh)
+
+	q, err := ch.QueueDeclare("data-queue", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	now := time.Now()
+
+	err = ch.Publish("", q.Name(), []byte("teste"), wabbit.Option{
+		"headers":         amqp.Table{"format": "pdf"},
+		"contentType":     "application/json",
+		"contentEncoding": "gzip",
+		"deliveryMode":    amqp.Persistent,
+		"priority":        uint8(5),
+		"messageId":       "12345",
+		"correlationId":   "abc",
+		"replyTo":         "replies",
+		"expiration":      "60000",
+		"timestamp":       now,
+		"type":            "order.created",
+		"userId":          "guest",
+		"appId":           "billing",
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	deliveries, err := ch.Consume(q.Name(), "consumer", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var d wabbit.Delivery
+
+	select {
+	case d = <-deliveries:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Message not delivered")
+		return
+	}
+
+	if d.Exchange() != "" || d.RoutingKey() != q.Name() || d.ConsumerTag() != "consumer" || d.Redelivered() {
+		t.Errorf("Unexpected delivery: %s %s %s %v", d.Exchange(), d.RoutingKey(), d.ConsumerTag(), d.Redelivered())
+		return
+	}
+
+	if d.Headers()["format"] != "pdf" || d.ContentType() != "application/json" ||
+		d.ContentEncoding() != "gzip" || d.DeliveryMode() != amqp.Persistent ||
+		d.Priority() != 5 || d.MessageId() != "12345" || d.CorrelationId() != "abc" ||
+		d.ReplyTo() != "replies" || d.Expiration() != "60000" || !d.Timestamp().Equal(now) ||
+		d.Type() != "order.created" || d.UserId() != "guest" || d.AppId() != "billing" {
+		t.Errorf("Unexpected delivery properties: %+v", d)
+		return
+	}
+
+	err = ch.Publish("", q.Name(), []byte("teste"), wabbit.Option{"NotExists": "bleh"})
+
+	if err == nil {
+		t.Errorf("Publish shall fail with invalid options")
+	}
+}
+
+func TestConsumerDeliveryTagsAndRedelivered(t *testing.T) {
+	vh := NewVHost("/")
+
+	q, err := vh.QueueDeclare("data-queue", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// both publishers would number their messages from 1
+	for _, body := range []string{"1", "2"} {
+		pub := NewChannel(vh)
+
+		if err = pub.Publish("", q.Name(), []byte(body), nil); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	ch := NewChannel(vh)
+
+	deliveries, err := ch.Consume(q.Name(), "consumer", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	receive := func() wabbit.Delivery {
+		select {
+		case d := <-deliveries:
+			return d
+		case <-time.After(5 * time.Second):
+			t.Errorf("Message not delivered")
+			return nil
+		}
+	}
+
+	for i := 1; i <= 2; i++ {
+		d := receive()
+
+		if d == nil {
+			return
+		}
+
+		if d.DeliveryTag() != uint64(i) || d.Redelivered() {
+			t.Errorf("Unexpected delivery of %s: tag %d, redelivered %v", d.Body(), d.DeliveryTag(), d.Redelivered())
+			return
+		}
+
+		if i == 1 {
+			if err = d.Ack(false); err != nil {
+				t.Error(err)
+				return
+			}
+		} else if err = d.Nack(false, true); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	d := receive()
+
+	if d == nil {
+		return
+	}
+
+	if string(d.Body()) != "2" || d.DeliveryTag() != 3 || !d.Redelivered() {
+		t.Errorf("Unexpected requeued delivery of %s: tag %d, redelivered %v", d.Body(), d.DeliveryTag(), d.Redelivered())
+		return
+	}
+
+	if err = ch.Close(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ch = NewChannel(vh)
+
+	d, ok, err := ch.Get(q.Name(), nil)
+
+	if err != nil || !ok {
+		t.Errorf("Unacked message not requeued on close: %v", err)
+		return
+	}
+
+	if string(d.Body()) != "2" || d.DeliveryTag() != 1 || !d.Redelivered() {
+		t.Errorf("Unexpected delivery after close of %s: tag %d, redelivered %v", d.Body(), d.DeliveryTag(), d.Redelivered())
+	}
+}
+
+func TestChannelException(t *testing.T) {
+	vh := NewVHost("/")
+
+	ch := NewChannel(vh)
+	errs := ch.NotifyClose(make(chan wabbit.Error, 1))
+
+	q, err := ch.QueueDeclare("data-queue", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ch.Publish("", q.Name(), []byte("teste"), nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	d, ok, err := ch.Get(q.Name(), nil)
+
+	if err != nil || !ok {
+		t.Errorf("Message not found: %v", err)
+		return
+	}
+
+	if err = d.Ack(false); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ch.Publish("", q.Name(), []byte("teste"), nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, _, err = ch.Get(q.Name(), nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// acked twice
+	err = d.Ack(false)
+
+	if e, ok := err.(wabbit.Error); !ok || e.Code() != utils.PreconditionFailed {
+		t.Errorf("Double ack shall fail with PRECONDITION_FAILED: %v", err)
+		return
+	}
+
+	select {
+	case e := <-errs:
+		if e == nil || e.Code() != utils.PreconditionFailed {
+			t.Errorf("Unexpected close notification: %v", e)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Channel exception not notified")
+		return
+	}
+
+	err = ch.Publish("", q.Name(), []byte("teste"), nil)
+
+	if e, ok := err.(wabbit.Error); !ok || e.Code() != utils.ChannelError {
+		t.Errorf("Publish on a closed channel shall fail: %v", err)
+		return
+	}
+
+	if _, err = ch.QueueDeclare("other-queue", nil); err == nil {
+		t.Errorf("QueueDeclare on a closed channel shall fail")
+		return
+	}
+
+	if err = ch.Close(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the unacked message was requeued by the exception
+	if q.Messages() != 1 {
+		t.Errorf("Unacked message not requeued: %d", q.Messages())
+		return
+	}
+
+	ch = NewChannel(vh)
+
+	err = ch.Publish("unknown", "", []byte("teste"), nil)
+
+	if e, ok := err.(wabbit.Error); !ok || e.Code() != utils.NotFound {
+		t.Errorf("Publish to an unknown exchange shall fail with NOT_FOUND: %v", err)
+		return
+	}
+
+	if _, _, err = ch.Get(q.Name(), nil); err != errClosed {
+		t.Errorf("Get on a closed channel shall fail: %v", err)
+	}
+}
+
+func TestConsumerStopRequeuesEveryMessage(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		vh := NewVHost("/")
+		ch := NewChannel(vh)
+
+		q, err := ch.QueueDeclare("data-queue", nil)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		for j := 0; j < 5; j++ {
+			if err = ch.Publish("", q.Name(), []byte("teste"), nil); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+
+		if _, err = ch.Consume(q.Name(), "consumer", nil); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if err = ch.Cancel("consumer", false); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if err = ch.Close(); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if q.Messages() != 5 {
+			t.Errorf("Messages lost by the stopped consumer: %d", q.Messages())
+			return
+		}
+	}
+}
+
+func TestAckMultipleZeroTag(t *testing.T) {
+	vh := NewVHost("/")
+	ch := NewChannel(vh)
+
+	q, err := ch.QueueDeclare("data-queue", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// nothing outstanding
+	if err = ch.Ack(0, true); err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		if err = ch.Publish("", q.Name(), []byte("teste"), nil); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if _, _, err = ch.Get(q.Name(), nil); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	if err = ch.Nack(0, true, true); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if q.Messages() != 3 {
+		t.Errorf("Outstanding messages not requeued: %d", q.Messages())
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, _, err = ch.Get(q.Name(), nil); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	if err = ch.Ack(0, true); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(ch.unacked) != 0 || q.Messages() != 0 {
+		t.Errorf("Outstanding messages not acked: %d", len(ch.unacked))
+		return
+	}
+
+	err = ch.Nack(1, true, true)
+
+	if e, ok := err.(wabbit.Error); !ok || e.Code() != utils.PreconditionFailed {
+		t.Errorf("Nack of an unknown tag shall fail with PRECONDITION_FAILED: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the time source of the message TTLs and queue expiry of the
+// fake broker, see VHost.SetClock.
+type Clock interface {
+	Now() time.Time
+
+	// AfterFunc calls f once d has elapsed. f is never called by
+	// AfterFunc itself, then the caller may hold locks taken by f.
+	AfterFunc(d time.Duration, f func())
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) {
+	time.AfterFunc(d, f)
+}
+
+// ManualClock is a Clock that only moves when advanced, then tests can
+// expire messages and queues without sleeping.
+type ManualClock struct {
+	mu     *sync.Mutex // Protects the fields below.
+	now    time.Time
+	timers []manualTimer
+}
+
+type manualTimer struct {
+	at time.Time
+	f  func()
+}
+
+// NewManualClock returns a clock stopped at now
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{
+		mu:  &sync.Mutex{},
+		now: now,
+	}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.timers = append(c.timers, manualTimer{c.now.Add(d), f})
+}
+
+// Advance moves the clock forward by d. The functions due are called in
+// the order of their deadlines before Advance returns.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+
+	c.now = c.now.Add(d)
+
+	var due, pending []manualTimer
+
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+
+	c.timers = pending
+	c.mu.Unlock()
+
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].at.Before(due[j].at)
+	})
+
+	for _, t := range due {
+		t.f()
+	}
+}
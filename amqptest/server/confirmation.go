@@ -1,5 +1,7 @@
 package server
 
+import "context"
+
 type Confirmation struct {
 	deliveryTag uint64
 	ack         bool
@@ -12,3 +14,39 @@ func (c Confirmation) Ack() bool {
 func (c Confirmation) DeliveryTag() uint64 {
 	return c.deliveryTag
 }
+
+// DeferredConfirmation is the publisher confirmation of a single message.
+// The fake server confirms the messages when they are published, then
+// it's always done.
+type DeferredConfirmation struct {
+	confirm Confirmation
+	done    chan struct{}
+}
+
+func newDeferredConfirmation(c Confirmation) *DeferredConfirmation {
+	done := make(chan struct{})
+	close(done)
+
+	return &DeferredConfirmation{confirm: c, done: done}
+}
+
+func (d *DeferredConfirmation) DeliveryTag() uint64 {
+	return d.confirm.deliveryTag
+}
+
+func (d *DeferredConfirmation) Done() <-chan struct{} {
+	return d.done
+}
+
+func (d *DeferredConfirmation) Acked() bool {
+	return d.confirm.ack
+}
+
+func (d *DeferredConfirmation) Wait(ctx context.Context) (bool, error) {
+	select {
+	case <-d.done:
+		return d.confirm.ack, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
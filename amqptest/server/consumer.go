@@ -0,0 +1,155 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/NeowayLabs/wabbit"
+)
+
+// consumer receives the messages dispatched by its queue and forwards
+// them to the deliveries channel returned by Consume.
+type consumer struct {
+	tag        string
+	channel    *Channel
+	queue      *Queue
+	deliveries chan wabbit.Delivery
+	done       chan bool
+	exited     chan struct{} // closed by run when it returns
+	stopped    chan struct{} // closed by stop
+	once       *sync.Once    // stops the consumer once
+
+	// prefetch limits the unacked deliveries of the consumer. Zero
+	// means no limit. Both are protected by the channel muQos.
+	prefetch int
+	unacked  int
+
+	mu     *sync.Mutex // Protects outbox.
+	outbox []wabbit.Delivery
+	ready  chan struct{} // signals new messages in the outbox
+}
+
+func newConsumer(ch *Channel, q *Queue, tag string, prefetch int) *consumer {
+	return &consumer{
+		tag:        tag,
+		channel:    ch,
+		queue:      q,
+		deliveries: make(chan wabbit.Delivery),
+		done:       make(chan bool),
+		exited:     make(chan struct{}),
+		stopped:    make(chan struct{}),
+		once:       &sync.Once{},
+		prefetch:   prefetch,
+		mu:         &sync.Mutex{},
+		ready:      make(chan struct{}, 1),
+	}
+}
+
+// enqueue appends a message dispatched by the queue to the outbox
+func (c *consumer) enqueue(d wabbit.Delivery) {
+	c.mu.Lock()
+	c.outbox = append(c.outbox, d)
+	c.mu.Unlock()
+
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (c *consumer) next() wabbit.Delivery {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.outbox) == 0 {
+		return nil
+	}
+
+	d := c.outbox[0]
+	c.outbox[0] = nil
+	c.outbox = c.outbox[1:]
+
+	return d
+}
+
+// run forwards the outbox to the deliveries channel until the consumer
+// is stopped.
+func (c *consumer) run() {
+	ch := c.channel
+
+	defer close(c.exited)
+
+	for {
+		d := c.next()
+
+		if d == nil {
+			select {
+			case <-c.done:
+				close(c.deliveries)
+				return
+			case <-c.ready:
+				continue
+			}
+		}
+
+		// since we keep track of unacked messages for
+		// the channel, we need to rebind the delivery
+		// to the consumer channel.
+		bd := bindDelivery(ch, ch.nextDeliveryTag(), d)
+		bd.consumerTag = c.tag
+		d = bd
+
+		ch.addUnacked(bd, c.queue, c)
+
+		// sub-select required for cases when
+		// client attempts to close the channel
+		// concurrently with re-enqueues of messages
+		select {
+		case c.deliveries <- d:
+		case <-c.done:
+			// the message never reached the client, then it
+			// goes back to the outbox to be requeued by stop.
+			ch.dropUnacked(d.DeliveryTag())
+
+			c.mu.Lock()
+			c.outbox = append([]wabbit.Delivery{d}, c.outbox...)
+			c.mu.Unlock()
+
+			close(c.deliveries)
+			return
+		}
+	}
+}
+
+// stop the consumer goroutine, unregister it from its queue and requeue
+// the messages dispatched to it but not delivered yet. The auto-delete
+// queues are deleted with their last consumer. Stopping a stopped
+// consumer is a no-op.
+func (c *consumer) stop() {
+	c.once.Do(c.shutdown)
+}
+
+// shutdown stops the consumer, see stop
+func (c *consumer) shutdown() {
+	autoDelete := c.queue.unsubscribe(c)
+	c.done <- true
+
+	// run may be putting back the message it was delivering
+	<-c.exited
+
+	c.mu.Lock()
+	pending := c.outbox
+	c.outbox = nil
+	c.mu.Unlock()
+
+	for range pending {
+		c.channel.release(c)
+	}
+
+	c.queue.requeue(pending)
+
+	if autoDelete && c.queue.vhost != nil {
+		c.queue.vhost.autoDelete(c.queue)
+	}
+
+	close(c.stopped)
+}
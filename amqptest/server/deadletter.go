@@ -0,0 +1,178 @@
+package server
+
+import (
+	"time"
+
+	"github.com/NeowayLabs/wabbit"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Reasons of dead-lettering, as found in the x-death headers
+const (
+	deathRejected = "rejected"
+	deathExpired  = "expired"
+	deathMaxLen   = "maxlen"
+)
+
+// deadLetter is a message that died in queue
+type deadLetter struct {
+	queue  *Queue
+	d      wabbit.Delivery
+	reason string
+}
+
+// reject dead-letters d, rejected or nacked without requeue from q
+func (v *VHost) reject(q *Queue, d wabbit.Delivery) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.deadLetter(q, []wabbit.Delivery{d}, deathRejected)
+}
+
+// deadLetter republishes ds through the dead-letter exchange of q. Must
+// be called with v.mu held.
+func (v *VHost) deadLetter(q *Queue, ds []wabbit.Delivery, reason string) {
+	dls := make([]deadLetter, 0, len(ds))
+
+	for _, d := range ds {
+		dls = append(dls, deadLetter{q, d, reason})
+	}
+
+	v.deadLetterAll(dls)
+}
+
+// deadLetterAll republishes the messages through the dead-letter exchange
+// of their queues, when they have one. Messages are dropped when the
+// exchange doesn't exist or when they cycle without being rejected. The
+// queues overflowing meanwhile dead-letter their messages too. Must be
+// called with v.mu held.
+func (v *VHost) deadLetterAll(dls []deadLetter) {
+	now := v.clock.Now()
+
+	for len(dls) > 0 {
+		dl := dls[0]
+		dls = dls[1:]
+
+		q := dl.queue
+
+		if !q.args.hasDeadLetter || (dl.reason != deathRejected && deathCycle(dl.d, q.name)) {
+			continue
+		}
+
+		exch, ok := v.exchanges[q.args.deadLetterExchange]
+
+		if !ok {
+			continue
+		}
+
+		key := dl.d.RoutingKey()
+
+		if q.args.hasDeadLetterKey {
+			key = q.args.deadLetterRoutingKey
+		}
+
+		d := deadLettered(dl.d, q.args.deadLetterExchange, key)
+		d.headers = deathHeaders(dl.d, q.name, dl.reason, now)
+
+		r, _ := exch.route(key, d)
+		dls = append(dls, r.overflowed...)
+	}
+}
+
+// deathCycle reports if d already died in queue and no rejection happened
+// since then. RabbitMQ drops such messages instead of dead-lettering them
+// forever, eg.: between two full queues.
+func deathCycle(d wabbit.Delivery, queue string) bool {
+	deaths, _ := d.Headers()["x-death"].([]interface{})
+
+	for _, v := range deaths {
+		death, ok := v.(amqp.Table)
+
+		if !ok {
+			continue
+		}
+
+		if death["reason"] == deathRejected {
+			return false
+		}
+
+		if death["queue"] == queue {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deadLettered returns a copy of d published to exchange with key. The
+// expiration of the message is removed, as RabbitMQ does, then it doesn't
+// expire again in the dead-letter queue.
+func deadLettered(d wabbit.Delivery, exchange, key string) *Delivery {
+	dl := bindDelivery(nil, 0, d)
+	dl.exchange = exchange
+	dl.routingKey = key
+	dl.redelivered = false
+	dl.expiration = ""
+	dl.expires = time.Time{}
+
+	return dl
+}
+
+// deathHeaders returns the headers of d with its death in queue recorded.
+// The x-death array has an entry per queue and reason, the most recent
+// first, counting the deaths. The x-first-death-* headers keep the first
+// one.
+func deathHeaders(d wabbit.Delivery, queue, reason string, now time.Time) wabbit.Option {
+	headers := make(wabbit.Option, len(d.Headers())+4)
+
+	for k, v := range d.Headers() {
+		headers[k] = v
+	}
+
+	deaths, _ := headers["x-death"].([]interface{})
+
+	var death amqp.Table
+
+	others := make([]interface{}, 0, len(deaths)+1)
+
+	for _, v := range deaths {
+		if t, ok := v.(amqp.Table); ok && death == nil && t["queue"] == queue && t["reason"] == reason {
+			death = make(amqp.Table, len(t))
+
+			for k, v := range t {
+				death[k] = v
+			}
+
+			continue
+		}
+
+		others = append(others, v)
+	}
+
+	if death == nil {
+		death = amqp.Table{
+			"queue":        queue,
+			"reason":       reason,
+			"exchange":     d.Exchange(),
+			"routing-keys": []interface{}{d.RoutingKey()},
+		}
+
+		if d.Expiration() != "" {
+			death["original-expiration"] = d.Expiration()
+		}
+	}
+
+	count, _ := headerNumber(death["count"])
+	death["count"] = int64(count) + 1
+	death["time"] = now
+
+	headers["x-death"] = append([]interface{}{death}, others...)
+
+	if _, ok := headers["x-first-death-reason"]; !ok {
+		headers["x-first-death-reason"] = reason
+		headers["x-first-death-queue"] = queue
+		headers["x-first-death-exchange"] = d.Exchange()
+	}
+
+	return headers
+}
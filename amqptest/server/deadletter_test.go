@@ -0,0 +1,124 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NeowayLabs/wabbit"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestDeadLetterRetryCycle(t *testing.T) {
+	clock := NewManualClock(time.Now())
+
+	vh := NewVHost("/")
+	vh.SetClock(clock)
+
+	ch := NewChannel(vh)
+
+	_, err := ch.QueueDeclare("work", wabbit.Option{
+		"args": amqp.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": "retry",
+		},
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	retry, err := ch.QueueDeclare("retry", wabbit.Option{
+		"args": amqp.Table{
+			"x-message-ttl":             1000,
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": "work",
+		},
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ch.Publish("", "work", []byte("teste"), nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i := 1; i <= 2; i++ {
+		d, ok, err := ch.Get("work", nil)
+
+		if err != nil || !ok {
+			t.Errorf("Message not found in the work queue: %v", err)
+			return
+		}
+
+		if i == 1 {
+			err = d.Reject(false)
+		} else {
+			err = d.Nack(false, false)
+		}
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if retry.Messages() != 1 {
+			t.Errorf("Rejected message not dead-lettered: %d", retry.Messages())
+			return
+		}
+
+		clock.Advance(time.Second)
+	}
+
+	d, ok, err := ch.Get("work", nil)
+
+	if err != nil || !ok {
+		t.Errorf("Message not found in the work queue: %v", err)
+		return
+	}
+
+	hdrs := d.Headers()
+
+	if hdrs["x-first-death-reason"] != "rejected" || hdrs["x-first-death-queue"] != "work" ||
+		hdrs["x-first-death-exchange"] != "" {
+		t.Errorf("Unexpected x-first-death headers: %v", hdrs)
+		return
+	}
+
+	deaths, ok := hdrs["x-death"].([]interface{})
+
+	if !ok || len(deaths) != 2 {
+		t.Errorf("Unexpected x-death header: %v", hdrs["x-death"])
+		return
+	}
+
+	for i, expected := range []struct {
+		queue, reason, exchange, key string
+	}{
+		{"retry", "expired", "", "retry"},
+		{"work", "rejected", "", "work"},
+	} {
+		death := deaths[i].(amqp.Table)
+
+		if death["queue"] != expected.queue || death["reason"] != expected.reason ||
+			death["exchange"] != expected.exchange || death["count"] != int64(2) {
+			t.Errorf("Unexpected x-death entry %d: %v", i, death)
+			return
+		}
+
+		keys, _ := death["routing-keys"].([]interface{})
+
+		if len(keys) != 1 || keys[0] != expected.key {
+			t.Errorf("Unexpected routing keys of x-death entry %d: %v", i, keys)
+			return
+		}
+
+		if _, ok := death["time"].(time.Time); !ok {
+			t.Errorf("Missing time of x-death entry %d: %v", i, death)
+			return
+		}
+	}
+}
@@ -4,19 +4,36 @@ import (
 	"time"
 
 	"github.com/NeowayLabs/wabbit"
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 type (
 	// Delivery is an interface to delivered messages
 	Delivery struct {
-		data          []byte
-		headers       wabbit.Option
-		tag           uint64
-		consumerTag   string
-		originalRoute string
-		messageId     string
-		channel       *Channel
-		contentType   string
+		data         []byte
+		headers      wabbit.Option
+		tag          uint64
+		consumerTag  string
+		redelivered  bool
+		exchange     string
+		routingKey   string
+		channel      *Channel
+		messageCount uint32
+		expires      time.Time // in the queue holding the message, see Queue.stamp
+
+		// message properties
+		messageId       string
+		contentType     string
+		contentEncoding string
+		deliveryMode    uint8
+		priority        uint8
+		correlationId   string
+		replyTo         string
+		expiration      string
+		timestamp       time.Time
+		messageType     string
+		userId          string
+		appId           string
 	}
 )
 
@@ -31,6 +48,72 @@ func NewDelivery(ch *Channel, data []byte, tag uint64, messageId string, hdrs wa
 	}
 }
 
+// newPublishedDelivery returns the message published to exchange with
+// the routing key and the properties of p. It has no delivery tag until
+// bound to the channel delivering it.
+func newPublishedDelivery(exchange, key string, p amqp.Publishing) *Delivery {
+	return &Delivery{
+		data:            p.Body,
+		headers:         wabbit.Option(p.Headers),
+		exchange:        exchange,
+		routingKey:      key,
+		messageId:       p.MessageId,
+		contentType:     p.ContentType,
+		contentEncoding: p.ContentEncoding,
+		deliveryMode:    p.DeliveryMode,
+		priority:        p.Priority,
+		correlationId:   p.CorrelationId,
+		replyTo:         p.ReplyTo,
+		expiration:      p.Expiration,
+		timestamp:       p.Timestamp,
+		messageType:     p.Type,
+		userId:          p.UserId,
+		appId:           p.AppId,
+	}
+}
+
+// bindDelivery returns a copy of d delivered by the channel ch with its
+// delivery tag, then acks and nacks of the copy are handled by ch. The
+// consumer tag isn't copied.
+func bindDelivery(ch *Channel, tag uint64, d wabbit.Delivery) *Delivery {
+	var expires time.Time
+
+	if qd, ok := d.(*Delivery); ok {
+		expires = qd.expires
+	}
+
+	return &Delivery{
+		data:            d.Body(),
+		headers:         d.Headers(),
+		tag:             tag,
+		redelivered:     d.Redelivered(),
+		exchange:        d.Exchange(),
+		routingKey:      d.RoutingKey(),
+		channel:         ch,
+		expires:         expires,
+		messageId:       d.MessageId(),
+		contentType:     d.ContentType(),
+		contentEncoding: d.ContentEncoding(),
+		deliveryMode:    d.DeliveryMode(),
+		priority:        d.Priority(),
+		correlationId:   d.CorrelationId(),
+		replyTo:         d.ReplyTo(),
+		expiration:      d.Expiration(),
+		timestamp:       d.Timestamp(),
+		messageType:     d.Type(),
+		userId:          d.UserId(),
+		appId:           d.AppId(),
+	}
+}
+
+// redelivery returns a copy of d to be requeued, flagged as redelivered
+func (d *Delivery) redelivery() *Delivery {
+	rd := *d
+	rd.redelivered = true
+
+	return &rd
+}
+
 func (d *Delivery) Ack(multiple bool) error {
 	return d.channel.Ack(d.tag, multiple)
 }
@@ -59,14 +142,66 @@ func (d *Delivery) ConsumerTag() string {
 	return d.consumerTag
 }
 
+func (d *Delivery) Redelivered() bool {
+	return d.redelivered
+}
+
+func (d *Delivery) Exchange() string {
+	return d.exchange
+}
+
+func (d *Delivery) RoutingKey() string {
+	return d.routingKey
+}
+
 func (d *Delivery) MessageId() string {
 	return d.messageId
 }
 
 func (d *Delivery) Timestamp() time.Time {
-	return time.Now()
+	return d.timestamp
 }
 
 func (d *Delivery) ContentType() string {
 	return d.contentType
 }
+
+func (d *Delivery) ContentEncoding() string {
+	return d.contentEncoding
+}
+
+func (d *Delivery) DeliveryMode() uint8 {
+	return d.deliveryMode
+}
+
+func (d *Delivery) Priority() uint8 {
+	return d.priority
+}
+
+func (d *Delivery) CorrelationId() string {
+	return d.correlationId
+}
+
+func (d *Delivery) ReplyTo() string {
+	return d.replyTo
+}
+
+func (d *Delivery) Expiration() string {
+	return d.expiration
+}
+
+func (d *Delivery) Type() string {
+	return d.messageType
+}
+
+func (d *Delivery) UserId() string {
+	return d.userId
+}
+
+func (d *Delivery) AppId() string {
+	return d.appId
+}
+
+func (d *Delivery) MessageCount() uint32 {
+	return d.messageCount
+}
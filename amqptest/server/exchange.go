@@ -3,29 +3,96 @@ package server
 import (
 	"fmt"
 	"sync"
+
+	"github.com/NeowayLabs/wabbit"
 )
 
 type Exchange interface {
-	route(route string, d *Delivery) error
+	// route delivers d to the queues matching the route
+	route(route string, d *Delivery) (routing, error)
 	addBinding(route string, b *BindingsMap)
-	delBinding(route string)
+	delBinding(route string, b *BindingsMap)
+
+	// unbindQueue removes every binding of q
+	unbindQueue(q *Queue)
+
+	// bound reports if any queue is bound to the exchange
+	bound() bool
 }
 
 type BindingsMap struct {
 	queue   *Queue
-	headers map[string]string
+	headers wabbit.Option // binding arguments
+}
+
+// bindingID identifies a binding. The same queue can be bound many times
+// to an exchange with distinct routing keys or arguments.
+type bindingID struct {
+	queue, route, args string
+}
+
+func newBindingID(route string, b *BindingsMap) bindingID {
+	// fmt prints maps sorted by key
+	return bindingID{b.queue.name, route, fmt.Sprint(b.headers)}
+}
+
+// routing is the outcome of routing a message
+type routing struct {
+	queues   int // queues matching the routing key
+	rejected int // queues that refused the message, eg.: on overflow
+
+	// messages to be dead-lettered by the vhost because the queues
+	// overflowed
+	overflowed []deadLetter
+}
+
+// deliver pushes d to the queue of every binding, once per queue.
+func deliver(bindings []*BindingsMap, d *Delivery) routing {
+	var r routing
+
+	seen := make(map[*Queue]bool, len(bindings))
+
+	for _, b := range bindings {
+		if seen[b.queue] {
+			continue
+		}
+
+		seen[b.queue] = true
+		r.queues++
+
+		accepted, dropped := b.queue.push(d)
+
+		if !accepted {
+			r.rejected++
+		}
+
+		for _, dd := range dropped {
+			r.overflowed = append(r.overflowed, deadLetter{b.queue, dd, deathMaxLen})
+		}
+	}
+
+	return r
+}
+
+// unbindQueue removes the bindings of q from bindings
+func unbindQueue(bindings map[bindingID]*BindingsMap, q *Queue) {
+	for id, b := range bindings {
+		if b.queue == q {
+			delete(bindings, id)
+		}
+	}
 }
 
 type TopicExchange struct {
 	name     string
-	bindings map[string]*BindingsMap
+	bindings *topicTrie
 	mu       *sync.RWMutex
 }
 
 func NewTopicExchange(name string) *TopicExchange {
 	return &TopicExchange{
 		name:     name,
-		bindings: make(map[string]*BindingsMap),
+		bindings: newTopicTrie(),
 		mu:       &sync.RWMutex{},
 	}
 }
@@ -33,39 +100,47 @@ func NewTopicExchange(name string) *TopicExchange {
 func (t *TopicExchange) addBinding(route string, b *BindingsMap) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	t.bindings[route] = b
+	t.bindings.add(route, b)
+}
+
+func (t *TopicExchange) delBinding(route string, b *BindingsMap) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bindings.del(route, b)
 }
 
-func (t *TopicExchange) delBinding(route string) {
+func (t *TopicExchange) unbindQueue(q *Queue) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	delete(t.bindings, route)
+	t.bindings.root.unbindQueue(q)
 }
 
-func (t *TopicExchange) route(route string, d *Delivery) error {
+// route delivers a copy of the message to every queue with a binding
+// matching the routing key.
+func (t *TopicExchange) bound() bool {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
-	for bname, bindings := range t.bindings {
-		if topicMatch(bname, route) {
-			bindings.queue.data <- d
-			return nil
-		}
-	}
+	return !t.bindings.empty()
+}
 
-	// The route doesnt match any binding, then will be discarded
-	return nil
+func (t *TopicExchange) route(route string, d *Delivery) (routing, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	// If the route doesnt match any binding, then will be discarded
+	return deliver(t.bindings.match(route), d), nil
 }
 
 type DirectExchange struct {
 	name     string
-	bindings map[string]*BindingsMap
+	bindings map[string][]*BindingsMap // bindings by routing key
 	mu       *sync.RWMutex
 }
 
 func NewDirectExchange(name string) *DirectExchange {
 	return &DirectExchange{
 		name:     name,
-		bindings: make(map[string]*BindingsMap),
+		bindings: make(map[string][]*BindingsMap),
 		mu:       &sync.RWMutex{},
 	}
 }
@@ -74,40 +149,92 @@ func (d *DirectExchange) addBinding(route string, b *BindingsMap) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	if d.bindings == nil {
-		d.bindings = make(map[string]*BindingsMap)
+		d.bindings = make(map[string][]*BindingsMap)
+	}
+
+	id := newBindingID(route, b)
+
+	for _, bound := range d.bindings[route] {
+		if newBindingID(route, bound) == id {
+			return
+		}
 	}
 
-	d.bindings[route] = b
+	d.bindings[route] = append(d.bindings[route], b)
 }
 
-func (d *DirectExchange) delBinding(route string) {
+func (d *DirectExchange) delBinding(route string, b *BindingsMap) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	delete(d.bindings, route)
+	id := newBindingID(route, b)
+	bindings := d.bindings[route]
+
+	for i, bound := range bindings {
+		if newBindingID(route, bound) == id {
+			bindings = append(bindings[:i], bindings[i+1:]...)
+			break
+		}
+	}
+
+	if len(bindings) == 0 {
+		delete(d.bindings, route)
+	} else {
+		d.bindings[route] = bindings
+	}
 }
 
-func (d *DirectExchange) route(route string, delivery *Delivery) error {
+func (d *DirectExchange) unbindQueue(q *Queue) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for route, bindings := range d.bindings {
+		kept := bindings[:0]
+
+		for _, b := range bindings {
+			if b.queue != q {
+				kept = append(kept, b)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(d.bindings, route)
+		} else {
+			d.bindings[route] = kept
+		}
+	}
+}
+
+func (d *DirectExchange) bound() bool {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
-	if bindings, ok := d.bindings[route]; ok {
-		bindings.queue.data <- delivery
-		return nil
+
+	for _, bindings := range d.bindings {
+		if len(bindings) > 0 {
+			return true
+		}
 	}
 
-	return fmt.Errorf("no bindings to route: %s", route)
+	return false
+}
 
+func (d *DirectExchange) route(route string, delivery *Delivery) (routing, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	// If the route doesnt match any binding, then will be discarded
+	return deliver(d.bindings[route], delivery), nil
 }
 
 type HeadersExchange struct {
 	name     string
-	bindings map[string]*BindingsMap
+	bindings map[bindingID]*BindingsMap
 	mu       *sync.RWMutex
 }
 
 func NewHeadersExchange(name string) *HeadersExchange {
 	return &HeadersExchange{
 		name:     name,
-		bindings: make(map[string]*BindingsMap),
+		bindings: make(map[bindingID]*BindingsMap),
 		mu:       &sync.RWMutex{},
 	}
 }
@@ -115,31 +242,97 @@ func NewHeadersExchange(name string) *HeadersExchange {
 func (t *HeadersExchange) addBinding(route string, b *BindingsMap) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	bindingKey := route
-	if bindingKey == "" {
-		bindingKey = b.queue.name
+	id := newBindingID(route, b)
+	if _, ok := t.bindings[id]; !ok {
+		t.bindings[id] = b
 	}
+}
 
-	t.bindings[bindingKey] = b
+func (t *HeadersExchange) delBinding(route string, b *BindingsMap) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.bindings, newBindingID(route, b))
 }
 
-func (t *HeadersExchange) delBinding(route string) {
+func (t *HeadersExchange) unbindQueue(q *Queue) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	delete(t.bindings, route)
+	unbindQueue(t.bindings, q)
 }
 
-func (t *HeadersExchange) route(route string, d *Delivery) error {
+func (t *HeadersExchange) bound() bool {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
+	return len(t.bindings) > 0
+}
+
+func (t *HeadersExchange) route(route string, d *Delivery) (routing, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	matches := make([]*BindingsMap, 0, len(t.bindings))
+
 	for _, bindings := range t.bindings {
-		if match, err := headersMatch(bindings, d); match {
-			bindings.queue.data <- d
-		} else if err != nil {
-			return err
+		if headersMatch(bindings, d) {
+			matches = append(matches, bindings)
 		}
 	}
 
 	// The headers doesnt match any attribute, then will be discarded
-	return nil
+	return deliver(matches, d), nil
+}
+
+// FanoutExchange routes a copy of every message to all bound queues. The
+// routing key is ignored.
+type FanoutExchange struct {
+	name     string
+	bindings map[bindingID]*BindingsMap
+	mu       *sync.RWMutex
+}
+
+func NewFanoutExchange(name string) *FanoutExchange {
+	return &FanoutExchange{
+		name:     name,
+		bindings: make(map[bindingID]*BindingsMap),
+		mu:       &sync.RWMutex{},
+	}
+}
+
+func (f *FanoutExchange) addBinding(route string, b *BindingsMap) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := newBindingID(route, b)
+	if _, ok := f.bindings[id]; !ok {
+		f.bindings[id] = b
+	}
+}
+
+func (f *FanoutExchange) delBinding(route string, b *BindingsMap) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.bindings, newBindingID(route, b))
+}
+
+func (f *FanoutExchange) unbindQueue(q *Queue) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	unbindQueue(f.bindings, q)
+}
+
+func (f *FanoutExchange) bound() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.bindings) > 0
+}
+
+func (f *FanoutExchange) route(_ string, d *Delivery) (routing, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	bindings := make([]*BindingsMap, 0, len(f.bindings))
+
+	for _, b := range f.bindings {
+		bindings = append(bindings, b)
+	}
+
+	// Without bindings the message is discarded
+	return deliver(bindings, d), nil
 }
@@ -0,0 +1,1188 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NeowayLabs/wabbit"
+	"github.com/NeowayLabs/wabbit/frame"
+	"github.com/NeowayLabs/wabbit/utils"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// wireFrameMax is the maximum frame size proposed on connection.tune
+	wireFrameMax = 128 * 1024
+
+	// wireHeartbeat is the heartbeat interval, in seconds, proposed on
+	// connection.tune
+	wireHeartbeat = 60
+)
+
+var wireConnSeq uint64
+
+type (
+	// wireConn is an AMQP 0-9-1 client connected to the TCP listener
+	wireConn struct {
+		id     string
+		server *AMQPServer
+		conn   net.Conn
+		r      *frame.Reader
+
+		muWrite *sync.Mutex // Protects w and frame interleaving
+		w       *frame.Writer
+
+		frameMax  uint32
+		heartbeat time.Duration
+
+		channels map[uint16]*wireChannel
+		done     chan struct{}
+		once     sync.Once
+	}
+
+	// wireChannel holds the wire state of an opened AMQP channel
+	wireChannel struct {
+		id      uint16
+		ch      *Channel
+		closing bool
+		confirm bool
+
+		// content being assembled for basic.publish
+		publish *wirePublish
+
+		// delivering has, for each consumer tag, a channel closed by
+		// its deliver goroutine after the last basic.deliver.
+		muDelivering *sync.Mutex
+		delivering   map[string]chan struct{}
+	}
+
+	wirePublish struct {
+		exchange  string
+		key       string
+		mandatory bool
+		size      uint64
+		header    bool
+		props     frame.Properties
+		body      []byte
+	}
+)
+
+// Listen binds a real TCP listener on addr and serves the AMQP 0-9-1 wire
+// protocol on it, backed by the server VHost. Any client speaking AMQP
+// 0-9-1, like rabbitmq/amqp091-go or wabbit/amqp, is able to connect.
+// If addr is empty the host and port of the server amqpuri are used.
+// Use "127.0.0.1:0" to pick a free port and Addr to find it.
+func (s *AMQPServer) Listen(addr string) error {
+	if addr == "" {
+		uri, err := amqp.ParseURI(s.amqpuri)
+
+		if err != nil {
+			return err
+		}
+
+		addr = net.JoinHostPort(uri.Host, fmt.Sprintf("%d", uri.Port))
+	}
+
+	l, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	s.muWire.Lock()
+	if s.listener != nil {
+		s.muWire.Unlock()
+		l.Close()
+		return fmt.Errorf("server already listening on %s", s.listener.Addr())
+	}
+	s.listener = l
+	s.muWire.Unlock()
+
+	go s.serve(l)
+	return nil
+}
+
+// Addr returns the address of the TCP listener or nil if the server
+// isn't listening.
+func (s *AMQPServer) Addr() net.Addr {
+	s.muWire.Lock()
+	defer s.muWire.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+
+	return s.listener.Addr()
+}
+
+func (s *AMQPServer) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+
+		if err != nil {
+			return
+		}
+
+		c := &wireConn{
+			id:       fmt.Sprintf("wire-%d", atomic.AddUint64(&wireConnSeq, 1)),
+			server:   s,
+			conn:     conn,
+			r:        frame.NewReader(conn),
+			w:        frame.NewWriter(conn),
+			muWrite:  &sync.Mutex{},
+			frameMax: wireFrameMax,
+			channels: make(map[uint16]*wireChannel),
+			done:     make(chan struct{}),
+		}
+
+		// frames are limited to frame-min until connection.tune-ok
+		c.r.MaxSize = utils.FrameMinSize - 8
+
+		s.muWire.Lock()
+		s.wireConns[c] = struct{}{}
+		s.muWire.Unlock()
+
+		go c.serve()
+	}
+}
+
+// stopListener closes the TCP listener and forces every wire connection
+// to close.
+func (s *AMQPServer) stopListener() {
+	s.muWire.Lock()
+	l := s.listener
+	conns := make([]*wireConn, 0, len(s.wireConns))
+	for c := range s.wireConns {
+		conns = append(conns, c)
+	}
+	s.listener = nil
+	s.muWire.Unlock()
+
+	if l != nil {
+		l.Close()
+	}
+
+	for _, c := range conns {
+		c.forceClose(utils.ConnectionForced, "CONNECTION_FORCED - broker forced connection closure")
+	}
+}
+
+func (c *wireConn) serve() {
+	defer c.shutdown()
+
+	if err := c.handshake(); err != nil {
+		return
+	}
+
+	for {
+		f, err := c.r.ReadFrame()
+
+		if err != nil {
+			return
+		}
+
+		switch f.Type {
+		case utils.FrameHeartbeat:
+			// any traffic keeps the connection alive
+		case utils.FrameMethod:
+			if f.Channel == 0 {
+				if !c.connectionMethod(f) {
+					return
+				}
+				continue
+			}
+
+			c.channelMethod(f)
+		case utils.FrameHeader, utils.FrameBody:
+			c.content(f)
+		default:
+			c.forceClose(utils.FrameError, "FRAME_ERROR - unknown frame type")
+			return
+		}
+	}
+}
+
+func (c *wireConn) handshake() error {
+	header, err := c.r.ReadProtocolHeader()
+
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(header, frame.ProtocolHeader) {
+		c.conn.Write(frame.ProtocolHeader)
+		return fmt.Errorf("unsupported protocol header: %q", header)
+	}
+
+	start := frame.NewEncoder()
+	start.Octet(0)
+	start.Octet(9)
+	start.Table(amqp.Table{
+		"product":  "wabbit",
+		"platform": "Go",
+		"capabilities": amqp.Table{
+			"publisher_confirms":     true,
+			"basic.nack":             true,
+			"consumer_cancel_notify": true,
+		},
+	})
+	start.LongStr("PLAIN AMQPLAIN")
+	start.LongStr("en_US")
+
+	if err := c.sendMethod(0, frame.ClassConnection, frame.ConnectionStart, start); err != nil {
+		return err
+	}
+
+	// credentials are accepted whatever they are
+	if _, err := c.expect(frame.ClassConnection, frame.ConnectionStartOk); err != nil {
+		return err
+	}
+
+	tune := frame.NewEncoder()
+	tune.Short(uint16(MaxChannels))
+	tune.Long(wireFrameMax)
+	tune.Short(wireHeartbeat)
+
+	if err := c.sendMethod(0, frame.ClassConnection, frame.ConnectionTune, tune); err != nil {
+		return err
+	}
+
+	args, err := c.expect(frame.ClassConnection, frame.ConnectionTuneOk)
+
+	if err != nil {
+		return err
+	}
+
+	args.Short() // channel-max
+	frameMax := args.Long()
+	heartbeat := args.Short()
+
+	if frameMax >= utils.FrameMinSize && frameMax < c.frameMax {
+		c.frameMax = frameMax
+	}
+
+	// frame-max counts the frame header and end octet too
+	c.r.MaxSize = c.frameMax - 8
+
+	c.heartbeat = time.Duration(heartbeat) * time.Second
+
+	if _, err = c.expect(frame.ClassConnection, frame.ConnectionOpen); err != nil {
+		return err
+	}
+
+	openOk := frame.NewEncoder()
+	openOk.ShortStr("")
+
+	if err := c.sendMethod(0, frame.ClassConnection, frame.ConnectionOpenOk, openOk); err != nil {
+		return err
+	}
+
+	if c.heartbeat > 0 {
+		go c.heartbeater()
+	}
+
+	return nil
+}
+
+// expect reads frames until a method frame arrives on channel zero and
+// returns its arguments if it's the wanted method.
+func (c *wireConn) expect(class, method uint16) (*frame.Decoder, error) {
+	for {
+		f, err := c.r.ReadFrame()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if f.Type == utils.FrameHeartbeat {
+			continue
+		}
+
+		if f.Channel != 0 {
+			return nil, frame.ErrFrame
+		}
+
+		gotClass, gotMethod, args, err := f.Method()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if gotClass != class || gotMethod != method {
+			return nil, fmt.Errorf("expected method %d.%d, got %d.%d", class, method, gotClass, gotMethod)
+		}
+
+		return args, nil
+	}
+}
+
+func (c *wireConn) heartbeater() {
+	ticker := time.NewTicker(c.heartbeat / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.muWrite.Lock()
+			err := c.w.WriteFrame(frame.NewHeartbeat())
+			if err == nil {
+				err = c.w.Flush()
+			}
+			c.muWrite.Unlock()
+
+			if err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// connectionMethod handles methods on channel zero and returns false
+// when the connection must be closed.
+func (c *wireConn) connectionMethod(f *frame.Frame) bool {
+	class, method, _, err := f.Method()
+
+	if err != nil || class != frame.ClassConnection {
+		c.forceClose(utils.CommandInvalid, "COMMAND_INVALID - unexpected method on channel zero")
+		return false
+	}
+
+	switch method {
+	case frame.ConnectionClose:
+		c.sendMethod(0, frame.ClassConnection, frame.ConnectionCloseOk, nil)
+		return false
+	case frame.ConnectionCloseOk:
+		return false
+	}
+
+	return true
+}
+
+func (c *wireConn) channelMethod(f *frame.Frame) {
+	id := f.Channel
+	class, method, args, err := f.Method()
+
+	if err != nil {
+		c.forceClose(utils.FrameError, "FRAME_ERROR - "+err.Error())
+		return
+	}
+
+	wch, ok := c.channels[id]
+
+	if !ok {
+		if class == frame.ClassChannel && method == frame.ChannelOpen {
+			c.openChannel(id)
+			return
+		}
+
+		c.forceClose(utils.ChannelError, fmt.Sprintf("CHANNEL_ERROR - unknown channel %d", id))
+		return
+	}
+
+	if wch.closing {
+		// after sending channel.close every method but close-ok is
+		// discarded
+		if class == frame.ClassChannel && method == frame.ChannelCloseOk {
+			delete(c.channels, id)
+		}
+		return
+	}
+
+	if wch.publish != nil {
+		// the content of a basic.publish can't be interleaved with
+		// methods on its channel
+		c.forceClose(utils.UnexpectedFrame,
+			fmt.Sprintf("UNEXPECTED_FRAME - expected content of basic.publish on channel %d, got method %d.%d", id, class, method))
+		return
+	}
+
+	if err := c.dispatch(wch, class, method, args); err != nil {
+		c.channelError(wch, class, method, err)
+	}
+}
+
+func (c *wireConn) openChannel(id uint16) {
+	ch, err := c.server.addChannel(c.id)
+
+	if err != nil {
+		c.forceClose(utils.NotAllowed, "NOT_ALLOWED - "+err.Error())
+		return
+	}
+
+	wch := &wireChannel{
+		id:           id,
+		ch:           ch,
+		muDelivering: &sync.Mutex{},
+		delivering:   make(map[string]chan struct{}),
+	}
+	c.channels[id] = wch
+
+	ch.returned = func(r wabbit.Return) {
+		c.sendReturn(wch, r)
+	}
+
+	ch.cancelled = func(tag string) {
+		c.sendCancel(wch, tag)
+	}
+
+	openOk := frame.NewEncoder()
+	openOk.LongStr("")
+	c.sendMethod(id, frame.ClassChannel, frame.ChannelOpenOk, openOk)
+}
+
+func (c *wireConn) dispatch(wch *wireChannel, class, method uint16, args *frame.Decoder) error {
+	var err error
+
+	switch uint32(class)<<16 | uint32(method) {
+	case frame.ClassChannel<<16 | frame.ChannelClose:
+		wch.ch.Close()
+		delete(c.channels, wch.id)
+
+		// no basic.deliver may follow close-ok
+		wch.waitDelivered()
+		return c.sendMethod(wch.id, frame.ClassChannel, frame.ChannelCloseOk, nil)
+
+	case frame.ClassChannel<<16 | frame.ChannelFlow:
+		flowOk := frame.NewEncoder()
+		flowOk.Bit(args.Bit())
+		return c.sendMethod(wch.id, frame.ClassChannel, frame.ChannelFlowOk, flowOk)
+
+	case frame.ClassExchange<<16 | frame.ExchangeDeclare:
+		args.Short()
+		name, kind := args.ShortStr(), args.ShortStr()
+		passive, durable, autoDelete, internal, noWait := args.Bit(), args.Bit(), args.Bit(), args.Bit(), args.Bit()
+		opt := wabbit.Option{
+			"durable":    durable,
+			"autoDelete": autoDelete,
+			"internal":   internal,
+			"args":       args.Table(),
+		}
+
+		if args.Err() != nil {
+			return args.Err()
+		}
+
+		if passive {
+			err = wch.ch.ExchangeDeclarePassive(name, kind, opt)
+		} else {
+			err = wch.ch.ExchangeDeclare(name, kind, opt)
+		}
+
+		if err != nil || noWait {
+			return err
+		}
+
+		return c.sendMethod(wch.id, frame.ClassExchange, frame.ExchangeDeclareOk, nil)
+
+	case frame.ClassExchange<<16 | frame.ExchangeDelete:
+		args.Short()
+		name := args.ShortStr()
+		ifUnused, noWait := args.Bit(), args.Bit()
+
+		if args.Err() != nil {
+			return args.Err()
+		}
+
+		if err = wch.ch.ExchangeDelete(name, wabbit.Option{"ifUnused": ifUnused}); err != nil || noWait {
+			return err
+		}
+
+		return c.sendMethod(wch.id, frame.ClassExchange, frame.ExchangeDeleteOk, nil)
+
+	case frame.ClassQueue<<16 | frame.QueueDeclare:
+		var q wabbit.Queue
+
+		args.Short()
+		name := args.ShortStr()
+		passive, durable, exclusive, autoDelete, noWait := args.Bit(), args.Bit(), args.Bit(), args.Bit(), args.Bit()
+		opt := wabbit.Option{
+			"durable":    durable,
+			"exclusive":  exclusive,
+			"autoDelete": autoDelete,
+			"args":       args.Table(),
+		}
+
+		if args.Err() != nil {
+			return args.Err()
+		}
+
+		if passive {
+			q, err = wch.ch.QueueDeclarePassive(name, opt)
+		} else {
+			q, err = wch.ch.QueueDeclare(name, opt)
+		}
+
+		if err != nil || noWait {
+			return err
+		}
+
+		declareOk := frame.NewEncoder()
+		declareOk.ShortStr(q.Name())
+		declareOk.Long(uint32(q.Messages()))
+		declareOk.Long(uint32(q.Consumers()))
+		return c.sendMethod(wch.id, frame.ClassQueue, frame.QueueDeclareOk, declareOk)
+
+	case frame.ClassQueue<<16 | frame.QueueBind:
+		args.Short()
+		name, exchange, key := args.ShortStr(), args.ShortStr(), args.ShortStr()
+		noWait := args.Bit()
+		opt := wabbit.Option{"args": args.Table()}
+
+		if args.Err() != nil {
+			return args.Err()
+		}
+
+		if err = wch.ch.QueueBind(name, key, exchange, opt); err != nil || noWait {
+			return err
+		}
+
+		return c.sendMethod(wch.id, frame.ClassQueue, frame.QueueBindOk, nil)
+
+	case frame.ClassQueue<<16 | frame.QueueUnbind:
+		args.Short()
+		name, exchange, key := args.ShortStr(), args.ShortStr(), args.ShortStr()
+		opt := wabbit.Option{"args": args.Table()}
+
+		if args.Err() != nil {
+			return args.Err()
+		}
+
+		if err = wch.ch.QueueUnbind(name, key, exchange, opt); err != nil {
+			return err
+		}
+
+		return c.sendMethod(wch.id, frame.ClassQueue, frame.QueueUnbindOk, nil)
+
+	case frame.ClassQueue<<16 | frame.QueuePurge:
+		args.Short()
+		name, noWait := args.ShortStr(), args.Bit()
+
+		if args.Err() != nil {
+			return args.Err()
+		}
+
+		n, err := wch.ch.QueuePurge(name, nil)
+
+		if err != nil || noWait {
+			return err
+		}
+
+		purgeOk := frame.NewEncoder()
+		purgeOk.Long(uint32(n))
+		return c.sendMethod(wch.id, frame.ClassQueue, frame.QueuePurgeOk, purgeOk)
+
+	case frame.ClassQueue<<16 | frame.QueueDelete:
+		args.Short()
+		name := args.ShortStr()
+		ifUnused, ifEmpty, noWait := args.Bit(), args.Bit(), args.Bit()
+
+		if args.Err() != nil {
+			return args.Err()
+		}
+
+		n, err := wch.ch.QueueDelete(name, wabbit.Option{
+			"ifUnused": ifUnused,
+			"ifEmpty":  ifEmpty,
+		})
+
+		if err != nil || noWait {
+			return err
+		}
+
+		deleteOk := frame.NewEncoder()
+		deleteOk.Long(uint32(n))
+		return c.sendMethod(wch.id, frame.ClassQueue, frame.QueueDeleteOk, deleteOk)
+
+	case frame.ClassBasic<<16 | frame.BasicQos:
+		prefetchSize, prefetchCount, global := args.Long(), args.Short(), args.Bit()
+
+		if args.Err() != nil {
+			return args.Err()
+		}
+
+		if err = wch.ch.Qos(int(prefetchCount), int(prefetchSize), global); err != nil {
+			return err
+		}
+
+		return c.sendMethod(wch.id, frame.ClassBasic, frame.BasicQosOk, nil)
+
+	case frame.ClassBasic<<16 | frame.BasicConsume:
+		args.Short()
+		queue, tag := args.ShortStr(), args.ShortStr()
+		noLocal, noAck, exclusive, noWait := args.Bit(), args.Bit(), args.Bit(), args.Bit()
+		opt := wabbit.Option{
+			"noLocal":   noLocal,
+			"autoAck":   noAck,
+			"exclusive": exclusive,
+			"args":      args.Table(),
+		}
+
+		if args.Err() != nil {
+			return args.Err()
+		}
+
+		if tag == "" {
+			tag = uniqueConsumerTag()
+		}
+
+		deliveries, err := wch.ch.Consume(queue, tag, opt)
+
+		if err != nil {
+			return err
+		}
+
+		if !noWait {
+			consumeOk := frame.NewEncoder()
+			consumeOk.ShortStr(tag)
+
+			if err = c.sendMethod(wch.id, frame.ClassBasic, frame.BasicConsumeOk, consumeOk); err != nil {
+				return err
+			}
+		}
+
+		done := make(chan struct{})
+
+		wch.muDelivering.Lock()
+		wch.delivering[tag] = done
+		wch.muDelivering.Unlock()
+
+		go c.deliver(wch, tag, noAck, deliveries, done)
+		return nil
+
+	case frame.ClassBasic<<16 | frame.BasicCancel:
+		tag, noWait := args.ShortStr(), args.Bit()
+
+		if args.Err() != nil {
+			return args.Err()
+		}
+
+		if err = wch.ch.Cancel(tag, noWait); err != nil {
+			return err
+		}
+
+		// no basic.deliver may follow cancel-ok
+		wch.waitDelivered(tag)
+
+		if noWait {
+			return nil
+		}
+
+		cancelOk := frame.NewEncoder()
+		cancelOk.ShortStr(tag)
+		return c.sendMethod(wch.id, frame.ClassBasic, frame.BasicCancelOk, cancelOk)
+
+	case frame.ClassBasic<<16 | frame.BasicGet:
+		args.Short()
+		queue, noAck := args.ShortStr(), args.Bit()
+
+		if args.Err() != nil {
+			return args.Err()
+		}
+
+		d, ok, err := wch.ch.Get(queue, wabbit.Option{"autoAck": noAck})
+
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			getEmpty := frame.NewEncoder()
+			getEmpty.ShortStr("") // cluster-id
+			return c.sendMethod(wch.id, frame.ClassBasic, frame.BasicGetEmpty, getEmpty)
+		}
+
+		getOk := frame.NewEncoder()
+		getOk.LongLong(d.DeliveryTag())
+		getOk.Bit(d.Redelivered())
+		getOk.ShortStr(d.Exchange())
+		getOk.ShortStr(d.RoutingKey())
+		getOk.Long(d.MessageCount())
+
+		return c.sendContent(wch.id, frame.BasicGetOk, getOk, deliveryProperties(d), d.Body())
+
+	case frame.ClassBasic<<16 | frame.BasicPublish:
+		args.Short()
+		exchange, key := args.ShortStr(), args.ShortStr()
+		mandatory := args.Bit()
+
+		if args.Err() != nil {
+			return args.Err()
+		}
+
+		wch.publish = &wirePublish{exchange: exchange, key: key, mandatory: mandatory}
+		return nil
+
+	case frame.ClassBasic<<16 | frame.BasicAck:
+		tag, multiple := args.LongLong(), args.Bit()
+
+		if args.Err() != nil {
+			return args.Err()
+		}
+
+		return wch.ch.Ack(tag, multiple)
+
+	case frame.ClassBasic<<16 | frame.BasicNack:
+		tag, multiple, requeue := args.LongLong(), args.Bit(), args.Bit()
+
+		if args.Err() != nil {
+			return args.Err()
+		}
+
+		return wch.ch.Nack(tag, multiple, requeue)
+
+	case frame.ClassBasic<<16 | frame.BasicReject:
+		tag, requeue := args.LongLong(), args.Bit()
+
+		if args.Err() != nil {
+			return args.Err()
+		}
+
+		return wch.ch.Reject(tag, requeue)
+
+	case frame.ClassBasic<<16 | frame.BasicRecover, frame.ClassBasic<<16 | frame.BasicRecoverAsync:
+		requeue := args.Bit()
+
+		if args.Err() != nil {
+			return args.Err()
+		}
+
+		if err = wch.ch.Recover(requeue); err != nil || method == frame.BasicRecoverAsync {
+			return err
+		}
+
+		return c.sendMethod(wch.id, frame.ClassBasic, frame.BasicRecoverOk, nil)
+
+	case frame.ClassTx<<16 | frame.TxSelect:
+		if err = wch.ch.Tx(); err != nil {
+			return err
+		}
+
+		return c.sendMethod(wch.id, frame.ClassTx, frame.TxSelectOk, nil)
+
+	case frame.ClassTx<<16 | frame.TxCommit:
+		if err = wch.ch.TxCommit(); err != nil {
+			return err
+		}
+
+		return c.sendMethod(wch.id, frame.ClassTx, frame.TxCommitOk, nil)
+
+	case frame.ClassTx<<16 | frame.TxRollback:
+		if err = wch.ch.TxRollback(); err != nil {
+			return err
+		}
+
+		return c.sendMethod(wch.id, frame.ClassTx, frame.TxRollbackOk, nil)
+
+	case frame.ClassConfirm<<16 | frame.ConfirmSelect:
+		noWait := args.Bit()
+
+		if !wch.confirm {
+			wch.confirm = true
+
+			if err = wch.ch.Confirm(noWait); err != nil {
+				return err
+			}
+
+			go c.confirms(wch, wch.ch.NotifyPublish(make(chan wabbit.Confirmation)))
+		}
+
+		if noWait {
+			return nil
+		}
+
+		return c.sendMethod(wch.id, frame.ClassConfirm, frame.ConfirmSelectOk, nil)
+	}
+
+	return utils.NewError(utils.NotImplemented,
+		fmt.Sprintf("NOT_IMPLEMENTED - method %d.%d isn't supported by the fake server", class, method),
+		true, false)
+}
+
+// content assembles the header and body frames of a basic.publish and
+// publishes the message when it's complete.
+func (c *wireConn) content(f *frame.Frame) {
+	wch, ok := c.channels[f.Channel]
+
+	if !ok {
+		c.forceClose(utils.ChannelError, fmt.Sprintf("CHANNEL_ERROR - unknown channel %d", f.Channel))
+		return
+	}
+
+	if wch.closing {
+		return
+	}
+
+	pub := wch.publish
+
+	if pub == nil || pub.header == (f.Type == utils.FrameHeader) {
+		c.forceClose(utils.UnexpectedFrame, "UNEXPECTED_FRAME - content frame out of order")
+		return
+	}
+
+	if f.Type == utils.FrameHeader {
+		h, err := f.ContentHeader()
+
+		if err != nil {
+			c.forceClose(utils.FrameError, "FRAME_ERROR - "+err.Error())
+			return
+		}
+
+		pub.size = h.BodySize
+		pub.props = h.Properties
+		pub.header = true
+	} else {
+		pub.body = append(pub.body, f.Payload...)
+	}
+
+	if uint64(len(pub.body)) > pub.size {
+		c.forceClose(utils.UnexpectedFrame,
+			fmt.Sprintf("UNEXPECTED_FRAME - content body of %d bytes exceeds the body size %d", len(pub.body), pub.size))
+		return
+	}
+
+	if uint64(len(pub.body)) < pub.size {
+		return
+	}
+
+	wch.publish = nil
+
+	opt := wabbit.Option{
+		"headers":         pub.props.Headers,
+		"contentType":     pub.props.ContentType,
+		"contentEncoding": pub.props.ContentEncoding,
+		"deliveryMode":    pub.props.DeliveryMode,
+		"priority":        pub.props.Priority,
+		"messageId":       pub.props.MessageId,
+		"correlationId":   pub.props.CorrelationId,
+		"replyTo":         pub.props.ReplyTo,
+		"expiration":      pub.props.Expiration,
+		"timestamp":       pub.props.Timestamp,
+		"type":            pub.props.Type,
+		"userId":          pub.props.UserId,
+		"appId":           pub.props.AppId,
+		"mandatory":       pub.mandatory,
+	}
+
+	if err := wch.ch.Publish(pub.exchange, pub.key, pub.body, opt); err != nil {
+		c.channelError(wch, frame.ClassBasic, frame.BasicPublish, err)
+	}
+}
+
+// deliver forwards the deliveries of a consumer to the client, then
+// closes done.
+func (c *wireConn) deliver(wch *wireChannel, tag string, noAck bool, deliveries <-chan wabbit.Delivery, done chan struct{}) {
+	defer func() {
+		wch.muDelivering.Lock()
+
+		if wch.delivering[tag] == done {
+			delete(wch.delivering, tag)
+		}
+
+		wch.muDelivering.Unlock()
+		close(done)
+	}()
+
+	for d := range deliveries {
+		deliver := frame.NewEncoder()
+		deliver.ShortStr(tag)
+		deliver.LongLong(d.DeliveryTag())
+		deliver.Bit(d.Redelivered())
+		deliver.ShortStr(d.Exchange())
+		deliver.ShortStr(d.RoutingKey())
+
+		if err := c.sendContent(wch.id, frame.BasicDeliver, deliver, deliveryProperties(d), d.Body()); err != nil {
+			return
+		}
+
+		if noAck {
+			wch.ch.ack(d.DeliveryTag(), false) // not part of transactions
+		}
+	}
+}
+
+// deliveryProperties returns the content properties sent with d
+func deliveryProperties(d wabbit.Delivery) frame.Properties {
+	return frame.Properties{
+		Headers:         amqp.Table(d.Headers()),
+		ContentType:     d.ContentType(),
+		ContentEncoding: d.ContentEncoding(),
+		DeliveryMode:    d.DeliveryMode(),
+		Priority:        d.Priority(),
+		CorrelationId:   d.CorrelationId(),
+		ReplyTo:         d.ReplyTo(),
+		Expiration:      d.Expiration(),
+		MessageId:       d.MessageId(),
+		Timestamp:       d.Timestamp(),
+		Type:            d.Type(),
+		UserId:          d.UserId(),
+		AppId:           d.AppId(),
+	}
+}
+
+// waitDelivered blocks until the deliver goroutines of the stopped
+// consumer tags, or of every consumer when no tag is given, sent their
+// last basic.deliver.
+func (wch *wireChannel) waitDelivered(tags ...string) {
+	wch.muDelivering.Lock()
+	dones := make([]chan struct{}, 0, len(wch.delivering))
+
+	if len(tags) == 0 {
+		for _, done := range wch.delivering {
+			dones = append(dones, done)
+		}
+	}
+
+	for _, tag := range tags {
+		if done, ok := wch.delivering[tag]; ok {
+			dones = append(dones, done)
+		}
+	}
+
+	wch.muDelivering.Unlock()
+
+	for _, done := range dones {
+		<-done
+	}
+}
+
+// sendCancel notifies the client that the server cancelled the consumer
+// tag, after its last basic.deliver.
+func (c *wireConn) sendCancel(wch *wireChannel, tag string) {
+	wch.waitDelivered(tag)
+
+	cancel := frame.NewEncoder()
+	cancel.ShortStr(tag)
+	cancel.Bit(true) // no-wait
+
+	c.sendMethod(wch.id, frame.ClassBasic, frame.BasicCancel, cancel)
+}
+
+// sendReturn sends an unroutable mandatory message back to the client.
+// It's called by the publish, before the confirm of the message is
+// queued.
+func (c *wireConn) sendReturn(wch *wireChannel, r wabbit.Return) {
+	ret := frame.NewEncoder()
+	ret.Short(r.ReplyCode)
+	ret.ShortStr(r.ReplyText)
+	ret.ShortStr(r.Exchange)
+	ret.ShortStr(r.RoutingKey)
+
+	c.sendContent(wch.id, frame.BasicReturn, ret, publishProperties(r.Properties), r.Body)
+}
+
+// publishProperties returns the content properties of publish options
+func publishProperties(opt wabbit.Option) frame.Properties {
+	var props frame.Properties
+
+	props.Headers, _ = opt["headers"].(amqp.Table)
+	props.ContentType, _ = opt["contentType"].(string)
+	props.ContentEncoding, _ = opt["contentEncoding"].(string)
+	props.DeliveryMode, _ = opt["deliveryMode"].(uint8)
+	props.Priority, _ = opt["priority"].(uint8)
+	props.MessageId, _ = opt["messageId"].(string)
+	props.CorrelationId, _ = opt["correlationId"].(string)
+	props.ReplyTo, _ = opt["replyTo"].(string)
+	props.Expiration, _ = opt["expiration"].(string)
+	props.Timestamp, _ = opt["timestamp"].(time.Time)
+	props.Type, _ = opt["type"].(string)
+	props.UserId, _ = opt["userId"].(string)
+	props.AppId, _ = opt["appId"].(string)
+
+	return props
+}
+
+// confirms forwards publisher confirms to the client. Consecutive acks
+// already queued are sent as a single multiple ack, as RabbitMQ does
+// under load.
+func (c *wireConn) confirms(wch *wireChannel, confirms chan wabbit.Confirmation) {
+	var next wabbit.Confirmation
+
+	for {
+		confirm := next
+		next = nil
+
+		if confirm == nil {
+			var ok bool
+
+			if confirm, ok = <-confirms; !ok {
+				return
+			}
+		}
+
+		tag, multiple := confirm.DeliveryTag(), false
+
+	coalesce:
+		for confirm.Ack() {
+			select {
+			case n, ok := <-confirms:
+				if !ok {
+					break coalesce
+				}
+
+				if !n.Ack() || n.DeliveryTag() != tag+1 {
+					next = n
+					break coalesce
+				}
+
+				tag, multiple = n.DeliveryTag(), true
+			default:
+				break coalesce
+			}
+		}
+
+		method := uint16(frame.BasicAck)
+
+		if !confirm.Ack() {
+			method = frame.BasicNack
+		}
+
+		m := frame.NewEncoder()
+		m.LongLong(tag)
+		m.Bit(multiple)
+
+		if err := c.sendMethod(wch.id, frame.ClassBasic, method, m); err != nil {
+			return
+		}
+	}
+}
+
+// channelError closes the channel with a channel exception, or the
+// connection when the reply code is of a connection exception.
+func (c *wireConn) channelError(wch *wireChannel, class, method uint16, err error) {
+	code, text := replyOf(err)
+
+	if !softError(code) {
+		c.forceClose(code, text)
+		return
+	}
+
+	wch.closing = true
+	wch.publish = nil
+	wch.ch.Close()
+	wch.waitDelivered()
+
+	m := frame.NewEncoder()
+	m.Short(code)
+	m.ShortStr(text)
+	m.Short(class)
+	m.Short(method)
+	c.sendMethod(wch.id, frame.ClassChannel, frame.ChannelClose, m)
+}
+
+// forceClose sends connection.close to the client and closes the socket
+// without waiting for close-ok.
+func (c *wireConn) forceClose(code uint16, text string) {
+	m := frame.NewEncoder()
+	m.Short(code)
+	m.ShortStr(text)
+	m.Short(0)
+	m.Short(0)
+	c.sendMethod(0, frame.ClassConnection, frame.ConnectionClose, m)
+	c.conn.Close()
+}
+
+// shutdown releases every channel of the connection. Unacked messages
+// are requeued.
+func (c *wireConn) shutdown() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+
+		for id, wch := range c.channels {
+			wch.ch.Close()
+			delete(c.channels, id)
+		}
+
+		c.server.delChannels(c.id)
+		c.server.vhost.deleteExclusive(c.id)
+
+		c.server.muWire.Lock()
+		delete(c.server.wireConns, c)
+		c.server.muWire.Unlock()
+	})
+}
+
+func (c *wireConn) sendMethod(channel, class, method uint16, args *frame.Encoder) error {
+	f, err := frame.NewMethod(channel, class, method, args)
+
+	if err != nil {
+		return err
+	}
+
+	c.muWrite.Lock()
+	defer c.muWrite.Unlock()
+
+	if err = c.w.WriteFrame(f); err != nil {
+		return err
+	}
+
+	return c.w.Flush()
+}
+
+// sendContent writes a content-bearing method of the basic class followed
+// by its header and body frames without interleaving other frames of the
+// connection.
+func (c *wireConn) sendContent(channel, method uint16, args *frame.Encoder, props frame.Properties, body []byte) error {
+	frames := make([]*frame.Frame, 0, 3)
+
+	f, err := frame.NewMethod(channel, frame.ClassBasic, method, args)
+
+	if err != nil {
+		return err
+	}
+
+	frames = append(frames, f)
+
+	f, err = frame.NewContentHeader(channel, frame.ContentHeader{
+		Class:      frame.ClassBasic,
+		BodySize:   uint64(len(body)),
+		Properties: props,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	frames = append(frames, f)
+	frames = append(frames, frame.NewBody(channel, body, c.frameMax)...)
+
+	c.muWrite.Lock()
+	defer c.muWrite.Unlock()
+
+	for _, f := range frames {
+		if err = c.w.WriteFrame(f); err != nil {
+			return err
+		}
+	}
+
+	return c.w.Flush()
+}
+
+// softError reports if the reply code is of a channel exception. The
+// other codes are of connection exceptions.
+func softError(code uint16) bool {
+	switch code {
+	case utils.ContentTooLarge, utils.NoRoute, utils.NoConsumers, utils.AccessRefused,
+		utils.NotFound, utils.ResourceLocked, utils.PreconditionFailed:
+		return true
+	}
+
+	return false
+}
+
+// replyOf returns the reply code and text of a channel exception caused
+// by err. The errors other than AMQP exceptions are invalid arguments of
+// the method, then PRECONDITION_FAILED.
+func replyOf(err error) (uint16, string) {
+	if e, ok := err.(wabbit.Error); ok {
+		return uint16(e.Code()), e.Reason()
+	}
+
+	return utils.PreconditionFailed, "PRECONDITION_FAILED - " + err.Error()
+}
@@ -0,0 +1,1077 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/NeowayLabs/wabbit/frame"
+	"github.com/NeowayLabs/wabbit/utils"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func listenTCP(t *testing.T, amqpuri string) (*AMQPServer, *amqp.Connection) {
+	srv := NewServer(amqpuri)
+
+	if err := srv.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := amqp.Dial("amqp://guest:guest@" + srv.Addr().String() + "/")
+
+	if err != nil {
+		srv.Stop()
+		t.Fatal(err)
+	}
+
+	return srv, conn
+}
+
+func TestListenPublishConsume(t *testing.T) {
+	srv, conn := listenTCP(t, "amqp://localhost:35680/%2f")
+	defer srv.Stop()
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ch.ExchangeDeclare("neoway", "topic", true, false, false, false, nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	q, err := ch.QueueDeclare("wire-queue", false, false, false, false, nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ch.QueueBind(q.Name, "process.data", "neoway", false, nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ch.Confirm(false)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	deliveries, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	body := make([]byte, 3*wireFrameMax)
+	for i := range body {
+		body[i] = byte(i)
+	}
+
+	err = ch.Publish("neoway", "process.data", false, false, amqp.Publishing{
+		Headers:     amqp.Table{"retries": int32(3)},
+		ContentType: "application/octet-stream",
+		MessageId:   "msg-1",
+		Body:        body,
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case c := <-confirms:
+		if !c.Ack || c.DeliveryTag != 1 {
+			t.Errorf("Unexpected confirmation: %+v", c)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("No publish confirmation received")
+		return
+	}
+
+	select {
+	case d := <-deliveries:
+		if string(d.Body) != string(body) {
+			t.Errorf("Invalid body received: %d bytes", len(d.Body))
+		}
+
+		if d.ContentType != "application/octet-stream" || d.MessageId != "msg-1" {
+			t.Errorf("Invalid properties received: %q %q", d.ContentType, d.MessageId)
+		}
+
+		if d.Headers["retries"] != int32(3) {
+			t.Errorf("Invalid headers received: %v", d.Headers)
+		}
+
+		if err = d.Ack(false); err != nil {
+			t.Error(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Message not delivered")
+	}
+}
+
+func TestListenChannelException(t *testing.T) {
+	srv, conn := listenTCP(t, "amqp://localhost:35681/%2f")
+	defer srv.Stop()
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = ch.QueueDeclarePassive("not-declared", false, false, false, false, nil)
+
+	amqpErr, ok := err.(*amqp.Error)
+
+	if !ok || amqpErr.Code != amqp.NotFound {
+		t.Errorf("Expected NOT_FOUND channel exception, got: %v", err)
+		return
+	}
+
+	// the connection is still usable
+	ch, err = conn.Channel()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ch.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestListenStopClosesConnections(t *testing.T) {
+	srv, conn := listenTCP(t, "amqp://localhost:35682/%2f")
+
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	srv.Stop()
+
+	select {
+	case err := <-closed:
+		if err == nil || err.Code != amqp.ConnectionForced {
+			t.Errorf("Expected CONNECTION_FORCED, got: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Connection not closed by server stop")
+	}
+
+	if srv.Addr() != nil {
+		t.Errorf("Listener not closed")
+	}
+}
+
+func TestListenGet(t *testing.T) {
+	srv, conn := listenTCP(t, "amqp://localhost:35683/%2f")
+	defer srv.Stop()
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	q, err := ch.QueueDeclare("wire-get", false, false, false, false, nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, ok, err := ch.Get(q.Name, false)
+
+	if err != nil || ok {
+		t.Errorf("Get of empty queue shall return get-empty: %v %v", ok, err)
+		return
+	}
+
+	for _, body := range []string{"first", "second"} {
+		err = ch.Publish("", q.Name, false, false, amqp.Publishing{Body: []byte(body)})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	d, ok, err := ch.Get(q.Name, false)
+
+	if err != nil || !ok {
+		t.Errorf("Get failed: %v %v", ok, err)
+		return
+	}
+
+	if string(d.Body) != "first" || d.MessageCount != 1 {
+		t.Errorf("Unexpected get-ok: %s with %d remaining", d.Body, d.MessageCount)
+		return
+	}
+
+	if err = d.Ack(false); err != nil {
+		t.Error(err)
+		return
+	}
+
+	d, ok, err = ch.Get(q.Name, true)
+
+	if err != nil || !ok || string(d.Body) != "second" || d.MessageCount != 0 {
+		t.Errorf("Unexpected get-ok: %v %v", ok, err)
+	}
+}
+
+func TestListenMandatoryReturn(t *testing.T) {
+	srv, conn := listenTCP(t, "amqp://localhost:35684/%2f")
+	defer srv.Stop()
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+
+	err = ch.Publish("", "no-such-queue", true, false, amqp.Publishing{
+		MessageId: "msg-1",
+		Body:      []byte("teste"),
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case r := <-returns:
+		if r.ReplyCode != 312 || r.RoutingKey != "no-such-queue" ||
+			r.MessageId != "msg-1" || string(r.Body) != "teste" {
+			t.Errorf("Invalid basic.return: %+v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Mandatory message not returned")
+	}
+}
+
+func TestListenTx(t *testing.T) {
+	srv, conn := listenTCP(t, "amqp://localhost:35685/%2f")
+	defer srv.Stop()
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// a server named exclusive queue is new on every run, while the
+	// server is kept by uri
+	q, err := ch.QueueDeclare("", false, false, true, false, nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ch.Tx(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, commit := range []bool{false, true} {
+		err = ch.Publish("", q.Name, false, false, amqp.Publishing{Body: []byte("teste")})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if commit {
+			err = ch.TxCommit()
+		} else {
+			err = ch.TxRollback()
+		}
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	q, err = ch.QueueDeclarePassive(q.Name, false, false, false, false, nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if q.Messages != 1 {
+		t.Errorf("Expected only the committed message in the queue: %d", q.Messages)
+	}
+}
+
+func TestListenDeferredConfirms(t *testing.T) {
+	srv, conn := listenTCP(t, "amqp://localhost:35686/%2f")
+	defer srv.Stop()
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	q, err := ch.QueueDeclare("wire-confirms", false, false, false, false, nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ch.Confirm(false); err != nil {
+		t.Error(err)
+		return
+	}
+
+	confirmations := make([]*amqp.DeferredConfirmation, 0, 100)
+
+	for i := 0; i < 100; i++ {
+		dc, err := ch.PublishWithDeferredConfirm("", q.Name, false, false, amqp.Publishing{Body: []byte("teste")})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		confirmations = append(confirmations, dc)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, dc := range confirmations {
+		acked, err := dc.WaitContext(ctx)
+
+		if err != nil || !acked {
+			t.Errorf("Publish of tag %d not acked: %v", dc.DeliveryTag, err)
+			return
+		}
+	}
+}
+
+func TestListenMessageProperties(t *testing.T) {
+	srv, conn := listenTCP(t, "amqp://localhost:35687/%2f")
+	defer srv.Stop()
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ch.ExchangeDeclare("neoway", "topic", true, false, false, false, nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	q, err := ch.QueueDeclare("wire-properties", false, false, false, false, nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ch.QueueBind(q.Name, "process.#", "neoway", false, nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	deliveries, err := ch.Consume(q.Name, "props-consumer", true, false, false, false, nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	published := amqp.Publishing{
+		Headers:         amqp.Table{"format": "pdf"},
+		ContentType:     "application/json",
+		ContentEncoding: "gzip",
+		DeliveryMode:    amqp.Persistent,
+		Priority:        5,
+		CorrelationId:   "abc",
+		ReplyTo:         "replies",
+		Expiration:      "60000",
+		MessageId:       "12345",
+		Timestamp:       time.Unix(1500000000, 0),
+		Type:            "order.created",
+		UserId:          "guest",
+		AppId:           "billing",
+		Body:            []byte("teste"),
+	}
+
+	if err = ch.Publish("neoway", "process.data", false, false, published); err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case d := <-deliveries:
+		if d.Exchange != "neoway" || d.RoutingKey != "process.data" || d.ConsumerTag != "props-consumer" {
+			t.Errorf("Unexpected delivery method: %s %s %s", d.Exchange, d.RoutingKey, d.ConsumerTag)
+			return
+		}
+
+		if d.Headers["format"] != "pdf" || d.ContentType != published.ContentType ||
+			d.ContentEncoding != published.ContentEncoding || d.DeliveryMode != published.DeliveryMode ||
+			d.Priority != published.Priority || d.CorrelationId != published.CorrelationId ||
+			d.ReplyTo != published.ReplyTo || d.Expiration != published.Expiration ||
+			d.MessageId != published.MessageId || !d.Timestamp.Equal(published.Timestamp) ||
+			d.Type != published.Type || d.UserId != published.UserId || d.AppId != published.AppId {
+			t.Errorf("Unexpected delivery properties: %+v", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Message not delivered")
+	}
+}
+
+func TestListenDeadLetter(t *testing.T) {
+	srv, conn := listenTCP(t, "amqp://localhost:35688/%2f")
+	defer srv.Stop()
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = ch.QueueDeclare("wire-work", false, false, false, false, amqp.Table{
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": "wire-dead",
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err = ch.QueueDeclare("wire-dead", false, false, false, false, nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ch.Publish("", "wire-work", false, false, amqp.Publishing{Body: []byte("teste")}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	var d amqp.Delivery
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; {
+		var ok bool
+
+		if d, ok, err = ch.Get("wire-work", false); err != nil || ok {
+			break
+		}
+	}
+
+	if err != nil || d.Body == nil {
+		t.Errorf("Message not found in the work queue: %v", err)
+		return
+	}
+
+	if err = d.Reject(false); err != nil {
+		t.Error(err)
+		return
+	}
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; {
+		var ok bool
+
+		if d, ok, err = ch.Get("wire-dead", true); err != nil || ok {
+			break
+		}
+	}
+
+	if err != nil || d.RoutingKey != "wire-dead" {
+		t.Errorf("Rejected message not dead-lettered: %v", err)
+		return
+	}
+
+	deaths, ok := d.Headers["x-death"].([]interface{})
+
+	if !ok || len(deaths) != 1 {
+		t.Errorf("Unexpected x-death header: %v", d.Headers)
+		return
+	}
+
+	death, ok := deaths[0].(amqp.Table)
+
+	if !ok || death["reason"] != "rejected" || death["queue"] != "wire-work" || death["count"] != int64(1) {
+		t.Errorf("Unexpected x-death entry: %v", deaths[0])
+	}
+}
+
+func TestListenReturnBeforeAck(t *testing.T) {
+	srv, conn := listenTCP(t, "amqp://localhost:35689/%2f")
+	defer srv.Stop()
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ch.Confirm(false); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the client reader blocks on the unbuffered returns, then the ack
+	// can't be received before the return is read
+	returns := ch.NotifyReturn(make(chan amqp.Return))
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	err = ch.Publish("", "no-such-queue", true, false, amqp.Publishing{
+		Body: []byte("teste"),
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	acked := false
+
+	select {
+	case c := <-confirms:
+		t.Errorf("basic.ack received before basic.return: %+v", c)
+		acked = true
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// read the return anyway, unblocking the client
+	select {
+	case <-returns:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Mandatory message not returned")
+		return
+	}
+
+	if acked {
+		return
+	}
+
+	select {
+	case c := <-confirms:
+		if !c.Ack || c.DeliveryTag != 1 {
+			t.Errorf("Unexpected confirm: %+v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Publish not confirmed")
+	}
+}
+
+func TestListenQueueDeleteCancelsConsumers(t *testing.T) {
+	srv, conn := listenTCP(t, "amqp://localhost:35690/%2f")
+	defer srv.Stop()
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	q, err := ch.QueueDeclare("", false, true, true, false, nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cancels := ch.NotifyCancel(make(chan string, 1))
+
+	deliveries, err := ch.Consume(q.Name, "consumer", false, false, false, false, nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err = ch.QueueDelete(q.Name, false, false, false); err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case tag := <-cancels:
+		if tag != "consumer" {
+			t.Errorf("Unexpected cancelled consumer: %s", tag)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("basic.cancel not received")
+		return
+	}
+
+	select {
+	case _, ok := <-deliveries:
+		if ok {
+			t.Errorf("Unexpected delivery")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Deliveries of the cancelled consumer not closed")
+	}
+}
+
+func TestListenNoDeliveryAfterCloseOrCancel(t *testing.T) {
+	srv, conn := listenTCP(t, "amqp://localhost:35691/%2f")
+	defer srv.Stop()
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i := 0; i < 100; i++ {
+		q, err := ch.QueueDeclare("", false, false, true, false, nil)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		for j := 0; j < 100; j++ {
+			err = ch.Publish("", q.Name, false, false, amqp.Publishing{Body: []byte("teste")})
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+
+		consumer, err := conn.Channel()
+
+		if err != nil {
+			t.Errorf("Round %d: %v", i, err)
+			return
+		}
+
+		deliveries, err := consumer.Consume(q.Name, "consumer", true, false, false, false, nil)
+
+		if err != nil {
+			t.Errorf("Round %d: %v", i, err)
+			return
+		}
+
+		<-deliveries
+
+		if i%2 == 0 {
+			if err = consumer.Close(); err != nil {
+				t.Errorf("Round %d: %v", i, err)
+				return
+			}
+
+			continue
+		}
+
+		if err = consumer.Cancel("consumer", false); err != nil {
+			t.Errorf("Round %d: %v", i, err)
+			return
+		}
+
+		// the auto acked messages sent before cancel-ok reach the
+		// client
+		received := 1
+
+		for range deliveries {
+			received++
+		}
+
+		if err = consumer.Close(); err != nil {
+			t.Errorf("Round %d: %v", i, err)
+			return
+		}
+
+		q, err = ch.QueueDeclarePassive(q.Name, false, false, true, false, nil)
+
+		if err != nil {
+			t.Errorf("Round %d: %v", i, err)
+			return
+		}
+
+		if received+q.Messages != 100 {
+			t.Errorf("Round %d: messages lost, %d received and %d queued", i, received, q.Messages)
+			return
+		}
+	}
+
+	if conn.IsClosed() {
+		t.Errorf("Connection closed by a basic.deliver after close-ok")
+	}
+}
+
+func TestListenPurgeExchangeDeleteRecover(t *testing.T) {
+	srv, conn := listenTCP(t, "amqp://localhost:35692/%2f")
+	defer srv.Stop()
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	q, err := ch.QueueDeclare("", false, false, true, false, nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		if err = ch.Publish("", q.Name, false, false, amqp.Publishing{Body: []byte("teste")}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	n, err := ch.QueuePurge(q.Name, false)
+
+	if err != nil || n != 3 {
+		t.Errorf("Unexpected purge of %d messages: %v", n, err)
+		return
+	}
+
+	if err = ch.ExchangeDeclare("wire-delete", "fanout", false, false, false, false, nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ch.QueueBind(q.Name, "", "wire-delete", false, nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ch.ExchangeDelete("wire-delete", false, false); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// publishing to the deleted exchange is an exception
+	if err = ch.Publish("wire-delete", "", false, false, amqp.Publishing{Body: []byte("teste")}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err = ch.QueueDeclarePassive(q.Name, false, false, true, false, nil); err == nil {
+		t.Errorf("Publish to the deleted exchange shall fail")
+		return
+	}
+
+	if ch, err = conn.Channel(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ch.Publish("", q.Name, false, false, amqp.Publishing{Body: []byte("teste")}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	deliveries, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if d := <-deliveries; d.Redelivered {
+		t.Errorf("First delivery flagged as redelivered")
+		return
+	}
+
+	if err = ch.Recover(true); err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case d := <-deliveries:
+		if !d.Redelivered {
+			t.Errorf("Recovered message not flagged as redelivered")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Recovered message not redelivered")
+	}
+}
+
+// rawConn is a bare AMQP client, able to send the malformed content a
+// client library wouldn't.
+type rawConn struct {
+	conn net.Conn
+	r    *frame.Reader
+	w    *frame.Writer
+}
+
+// dialRaw connects to srv and opens the channel 1
+func dialRaw(t *testing.T, srv *AMQPServer) *rawConn {
+	conn, err := net.Dial("tcp", srv.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &rawConn{conn: conn, r: frame.NewReader(conn), w: frame.NewWriter(conn)}
+
+	if _, err = conn.Write(frame.ProtocolHeader); err != nil {
+		t.Fatal(err)
+	}
+
+	c.expect(t, frame.ClassConnection, frame.ConnectionStart)
+
+	startOk := frame.NewEncoder()
+	startOk.Table(amqp.Table{})
+	startOk.ShortStr("PLAIN")
+	startOk.LongStr("\x00guest\x00guest")
+	startOk.ShortStr("en_US")
+	c.send(t, 0, frame.ClassConnection, frame.ConnectionStartOk, startOk)
+
+	c.expect(t, frame.ClassConnection, frame.ConnectionTune)
+
+	tuneOk := frame.NewEncoder()
+	tuneOk.Short(0)
+	tuneOk.Long(utils.FrameMinSize)
+	tuneOk.Short(0)
+	c.send(t, 0, frame.ClassConnection, frame.ConnectionTuneOk, tuneOk)
+
+	open := frame.NewEncoder()
+	open.ShortStr("/")
+	open.ShortStr("")
+	open.Bit(false)
+	c.send(t, 0, frame.ClassConnection, frame.ConnectionOpen, open)
+	c.expect(t, frame.ClassConnection, frame.ConnectionOpenOk)
+
+	channelOpen := frame.NewEncoder()
+	channelOpen.ShortStr("")
+	c.send(t, 1, frame.ClassChannel, frame.ChannelOpen, channelOpen)
+	c.expect(t, frame.ClassChannel, frame.ChannelOpenOk)
+
+	return c
+}
+
+func (c *rawConn) send(t *testing.T, channel, class, method uint16, args *frame.Encoder) {
+	f, err := frame.NewMethod(channel, class, method, args)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.write(t, f)
+}
+
+func (c *rawConn) write(t *testing.T, frames ...*frame.Frame) {
+	for _, f := range frames {
+		if err := c.w.WriteFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expect reads the next method, skipping heartbeats, and fails unless
+// it's the wanted one.
+func (c *rawConn) expect(t *testing.T, class, method uint16) *frame.Decoder {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for {
+		f, err := c.r.ReadFrame()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if f.Type == utils.FrameHeartbeat {
+			continue
+		}
+
+		gotClass, gotMethod, args, err := f.Method()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if gotClass != class || gotMethod != method {
+			t.Fatalf("Expected method %d.%d, got %d.%d", class, method, gotClass, gotMethod)
+		}
+
+		return args
+	}
+}
+
+// publish sends a basic.publish to the default exchange
+func (c *rawConn) publish(t *testing.T) {
+	publish := frame.NewEncoder()
+	publish.Short(0)
+	publish.ShortStr("")
+	publish.ShortStr("raw")
+	publish.Bit(false)
+	publish.Bit(false)
+	c.send(t, 1, frame.ClassBasic, frame.BasicPublish, publish)
+}
+
+func TestListenMalformedContent(t *testing.T) {
+	srv := NewServer("amqp://localhost:35693/%2f")
+	defer srv.Stop()
+
+	if err := srv.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, send := range map[string]func(c *rawConn){
+		"body bigger than the body size": func(c *rawConn) {
+			c.publish(t)
+
+			header, err := frame.NewContentHeader(1, frame.ContentHeader{Class: frame.ClassBasic, BodySize: 2})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.write(t, header)
+			c.write(t, frame.NewBody(1, []byte("teste"), utils.FrameMinSize)...)
+		},
+		"publish before the content": func(c *rawConn) {
+			c.publish(t)
+			c.publish(t)
+		},
+	} {
+		c := dialRaw(t, srv)
+		send(c)
+
+		args := c.expect(t, frame.ClassConnection, frame.ConnectionClose)
+
+		if code := args.Short(); code != utils.UnexpectedFrame {
+			t.Errorf("%s: unexpected connection close %d %s", name, code, args.ShortStr())
+		}
+
+		c.conn.Close()
+	}
+}
+
+func TestListenExceptionCodes(t *testing.T) {
+	srv := NewServer("amqp://localhost:35694/%2f")
+	defer srv.Stop()
+
+	if err := srv.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _ := replyOf(errors.New("invalid argument")); code != utils.PreconditionFailed {
+		t.Errorf("Unexpected code of an internal error: %d", code)
+		return
+	}
+
+	// NOT_IMPLEMENTED is a connection exception
+	c := dialRaw(t, srv)
+	defer c.conn.Close()
+
+	bind := frame.NewEncoder()
+	bind.Short(0)
+	bind.ShortStr("amq.fanout")
+	bind.ShortStr("amq.direct")
+	bind.ShortStr("")
+	bind.Bit(false)
+	bind.Table(amqp.Table{})
+	c.send(t, 1, frame.ClassExchange, frame.ExchangeBind, bind)
+
+	args := c.expect(t, frame.ClassConnection, frame.ConnectionClose)
+
+	if code := args.Short(); code != utils.NotImplemented {
+		t.Errorf("Unexpected connection close %d %s", code, args.ShortStr())
+	}
+}
+
+func TestListenFrameLimitBeforeTune(t *testing.T) {
+	srv := NewServer("amqp://localhost:35695/%2f")
+	defer srv.Stop()
+
+	if err := srv.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	c := &rawConn{conn: conn, r: frame.NewReader(conn), w: frame.NewWriter(conn)}
+
+	if _, err = conn.Write(frame.ProtocolHeader); err != nil {
+		t.Fatal(err)
+	}
+
+	c.expect(t, frame.ClassConnection, frame.ConnectionStart)
+
+	// a method frame header of 1 MiB, its payload is never sent
+	if _, err = conn.Write([]byte{utils.FrameMethod, 0, 0, 0, 0x10, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	buf := make([]byte, 512)
+
+	for err == nil {
+		_, err = conn.Read(buf)
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Errorf("Connection not closed on a frame bigger than frame-min before tune-ok")
+	}
+}
@@ -1,31 +1,670 @@
 package server
 
-import "github.com/NeowayLabs/wabbit"
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NeowayLabs/wabbit"
+)
 
 const (
+	// QueueMaxLen is the initial capacity of the per channel buffers.
+	// Queues aren't limited by it.
 	QueueMaxLen = 2 << 8
 )
 
+// Queue is a FIFO of messages, limited only by its x-max-length and
+// x-max-length-bytes arguments. Queues declared with x-max-priority keep
+// a FIFO per message priority, delivering the higher priorities first.
+// Messages are dispatched round-robin to the consumers with prefetch
+// credit.
 type Queue struct {
-	name string
-	data chan wabbit.Delivery
+	name  string
+	vhost *VHost // nil for queues not declared in a vhost
+	args  queueArgs
+	flags queueFlags
+	owner string // connection owning the exclusive queue
+
+	mu        *sync.Mutex // Protects the fields below.
+	messages  []wabbit.Delivery
+	bytes     int // size of the ready message bodies
+	consumers []*consumer
+	next      int // next consumer of the round-robin
+
+	clock    Clock
+	lastUsed time.Time // for x-expires
+	timerAt  time.Time // deadline of the expiry timer armed, if any
+}
+
+// queueFlags are the queue declare options. Durability is recorded but
+// the fake broker keeps every queue in memory.
+type queueFlags struct {
+	durable    bool
+	exclusive  bool // deleted with its connection, locked to others
+	autoDelete bool // deleted when its last consumer is gone
+}
+
+// queueArgs are the queue arguments supported by the fake broker
+type queueArgs struct {
+	messageTTL time.Duration // x-message-ttl
+	hasTTL     bool
+	expires    time.Duration // x-expires, zero for never
+
+	deadLetterExchange   string // x-dead-letter-exchange
+	hasDeadLetter        bool
+	deadLetterRoutingKey string // x-dead-letter-routing-key
+	hasDeadLetterKey     bool
+
+	maxLength      int // x-max-length of ready messages
+	hasMaxLength   bool
+	maxLengthBytes int // x-max-length-bytes of the ready message bodies
+	hasMaxBytes    bool
+	overflow       string // x-overflow
+
+	maxPriority uint8 // x-max-priority, zero for FIFO queues
+
+	table wabbit.Option // as declared, see equivalenceArgs
+}
+
+// equivalenceArgs are the queue arguments that a redeclaration must
+// repeat, as in RabbitMQ.
+var equivalenceArgs = []string{
+	"x-message-ttl",
+	"x-expires",
+	"x-dead-letter-exchange",
+	"x-dead-letter-routing-key",
+	"x-max-length",
+	"x-max-length-bytes",
+	"x-overflow",
+	"x-max-priority",
+}
+
+// Overflow behaviours of the queues with length limits
+const (
+	overflowDropHead         = "drop-head"
+	overflowRejectPublish    = "reject-publish"
+	overflowRejectPublishDLX = "reject-publish-dlx"
+)
+
+// parseQueueFlags returns the flags of the queue declare options
+func parseQueueFlags(opt wabbit.Option) (queueFlags, error) {
+	var (
+		flags queueFlags
+		ok    bool
+	)
+
+	if v, found := opt["durable"]; found {
+		if flags.durable, ok = v.(bool); !ok {
+			return flags, errors.New("durable option is of type bool")
+		}
+	}
+
+	if v, found := opt["exclusive"]; found {
+		if flags.exclusive, ok = v.(bool); !ok {
+			return flags, errors.New("exclusive option is of type bool")
+		}
+	}
+
+	if v, found := opt["autoDelete"]; found {
+		if flags.autoDelete, ok = v.(bool); !ok {
+			return flags, errors.New("autoDelete option is of type bool")
+		}
+	}
+
+	return flags, nil
+}
+
+// parseQueueArgs returns the supported queue arguments, or the name of
+// the first invalid one.
+func parseQueueArgs(args wabbit.Option) (queueArgs, string) {
+	var (
+		qa = queueArgs{table: args}
+		ok bool
+	)
+
+	if v, found := args["x-message-ttl"]; found {
+		if qa.messageTTL, ok = argMillis(v); !ok {
+			return qa, "x-message-ttl"
+		}
+
+		qa.hasTTL = true
+	}
+
+	if v, found := args["x-expires"]; found {
+		if qa.expires, ok = argMillis(v); !ok || qa.expires == 0 {
+			return qa, "x-expires"
+		}
+	}
+
+	if v, found := args["x-dead-letter-exchange"]; found {
+		if qa.deadLetterExchange, ok = v.(string); !ok {
+			return qa, "x-dead-letter-exchange"
+		}
+
+		qa.hasDeadLetter = true
+	}
+
+	if v, found := args["x-dead-letter-routing-key"]; found {
+		if qa.deadLetterRoutingKey, ok = v.(string); !ok || !qa.hasDeadLetter {
+			return qa, "x-dead-letter-routing-key"
+		}
+
+		qa.hasDeadLetterKey = true
+	}
+
+	if v, found := args["x-max-length"]; found {
+		if qa.maxLength, ok = argCount(v); !ok {
+			return qa, "x-max-length"
+		}
+
+		qa.hasMaxLength = true
+	}
+
+	if v, found := args["x-max-length-bytes"]; found {
+		if qa.maxLengthBytes, ok = argCount(v); !ok {
+			return qa, "x-max-length-bytes"
+		}
+
+		qa.hasMaxBytes = true
+	}
+
+	qa.overflow = overflowDropHead
+
+	if v, found := args["x-overflow"]; found {
+		qa.overflow, _ = v.(string)
+
+		switch qa.overflow {
+		case overflowDropHead, overflowRejectPublish, overflowRejectPublishDLX:
+		default:
+			return qa, "x-overflow"
+		}
+	}
+
+	if v, found := args["x-max-priority"]; found {
+		n, ok := argCount(v)
+
+		if !ok || n > 255 {
+			return qa, "x-max-priority"
+		}
+
+		qa.maxPriority = uint8(n)
+	}
+
+	return qa, ""
+}
+
+// argCount converts a non-negative integer argument
+func argCount(v interface{}) (int, bool) {
+	n, ok := headerNumber(v)
+
+	if !ok || n < 0 || n != float64(int(n)) {
+		return 0, false
+	}
+
+	return int(n), true
+}
+
+// argMillis converts a non-negative integer argument in milliseconds
+func argMillis(v interface{}) (time.Duration, bool) {
+	n, ok := headerNumber(v)
+
+	if !ok || n < 0 || n != float64(int64(n)) {
+		return 0, false
+	}
+
+	return time.Duration(n) * time.Millisecond, true
+}
+
+// argEqual compares the values of a queue argument. Numbers are equal
+// regardless of their integer type.
+func argEqual(a, b interface{}) bool {
+	if x, ok := headerNumber(a); ok {
+		y, ok := headerNumber(b)
+		return ok && x == y
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// argValue formats a queue argument for the error messages
+func argValue(v interface{}, found bool) string {
+	if !found {
+		return "none"
+	}
+
+	return fmt.Sprintf("the value '%v'", v)
+}
+
+// messageExpiration parses the expiration property of a message
+func messageExpiration(expiration string) (time.Duration, bool) {
+	ms, err := strconv.ParseUint(expiration, 10, 32)
+
+	if err != nil {
+		return 0, false
+	}
+
+	return time.Duration(ms) * time.Millisecond, true
 }
 
 func NewQueue(name string) *Queue {
 	return &Queue{
-		name: name,
-		data: make(chan wabbit.Delivery, QueueMaxLen),
+		name:     name,
+		mu:       &sync.Mutex{},
+		messages: make([]wabbit.Delivery, 0),
+	}
+}
+
+// newVHostQueue returns a queue declared in v by the connection owner
+func newVHostQueue(v *VHost, name string, flags queueFlags, args queueArgs, owner string) *Queue {
+	q := NewQueue(name)
+	q.vhost = v
+	q.args = args
+	q.flags = flags
+
+	if flags.exclusive {
+		q.owner = owner
 	}
+	q.clock = v.clock
+	q.lastUsed = v.clock.Now()
+
+	if args.expires > 0 {
+		q.schedule(q.lastUsed.Add(args.expires))
+	}
+
+	return q
 }
 
 func (q *Queue) Consumers() int {
-	return 0
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.consumers)
 }
 
 func (q *Queue) Name() string {
 	return q.name
 }
 
+// Messages returns the number of messages ready to be delivered
 func (q *Queue) Messages() int {
-	return 0
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.messages)
+}
+
+// push appends d to the tail of the queue and reports if the queue
+// accepted it. When the queue overflows, it also returns the messages to
+// be dead-lettered: the dropped ones from the head, or d itself with the
+// reject-publish-dlx behaviour.
+func (q *Queue) push(d wabbit.Delivery) (bool, []wabbit.Delivery) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.overflows(d) {
+		switch q.args.overflow {
+		case overflowRejectPublish:
+			return false, nil
+		case overflowRejectPublishDLX:
+			return false, []wabbit.Delivery{d}
+		}
+	}
+
+	q.insert(q.stamp(d))
+	q.dispatch()
+
+	var dropped []wabbit.Delivery
+
+	for len(q.messages) > 0 && q.overflows(nil) {
+		dropped = append(dropped, q.shift())
+	}
+
+	return true, dropped
+}
+
+// overflows reports if the ready messages with d exceed the length
+// limits of the queue. Must be called with q.mu held.
+func (q *Queue) overflows(d wabbit.Delivery) bool {
+	length := len(q.messages)
+
+	if d != nil {
+		length++
+	}
+
+	if q.args.hasMaxLength && length > q.args.maxLength {
+		return true
+	}
+
+	if !q.args.hasMaxBytes {
+		return false
+	}
+
+	size := q.bytes
+
+	if d != nil {
+		size += len(d.Body())
+	}
+
+	return size > q.args.maxLengthBytes
+}
+
+// stamp returns d with its expiry in the queue, computed from the queue
+// TTL and the message expiration. Must be called with q.mu held.
+func (q *Queue) stamp(d wabbit.Delivery) wabbit.Delivery {
+	qd, ok := d.(*Delivery)
+
+	if !ok || q.vhost == nil {
+		return d
+	}
+
+	ttl, hasTTL := q.args.messageTTL, q.args.hasTTL
+
+	if qd.expiration != "" {
+		if msgTTL, ok := messageExpiration(qd.expiration); ok && (!hasTTL || msgTTL < ttl) {
+			ttl, hasTTL = msgTTL, true
+		}
+	}
+
+	if !hasTTL {
+		return d
+	}
+
+	// the same message can be routed to many queues
+	stamped := *qd
+	stamped.expires = q.clock.Now().Add(ttl)
+	q.schedule(stamped.expires)
+
+	return &stamped
+}
+
+// requeue puts ds back in the head of the queue keeping their order
+func (q *Queue) requeue(ds []wabbit.Delivery) {
+	if len(ds) == 0 {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	batch := ds
+
+	if q.args.maxPriority > 0 {
+		batch = append([]wabbit.Delivery(nil), ds...)
+
+		sort.SliceStable(batch, func(i, j int) bool {
+			return q.priority(batch[i]) > q.priority(batch[j])
+		})
+	}
+
+	// the messages are sorted by descending priority, the requeued ones
+	// go before the others of their priority.
+	messages := make([]wabbit.Delivery, 0, len(batch)+len(q.messages))
+	next := 0
+
+	for _, m := range q.messages {
+		for next < len(batch) && q.priority(batch[next]) >= q.priority(m) {
+			messages = append(messages, batch[next])
+			next++
+		}
+
+		messages = append(messages, m)
+	}
+
+	q.messages = append(messages, batch[next:]...)
+
+	for _, d := range batch {
+		q.bytes += len(d.Body())
+	}
+
+	q.dispatch()
+}
+
+// insert puts d in the tail of the queue. Priority queues do it after
+// the messages of the same priority. Must be called with q.mu held.
+func (q *Queue) insert(d wabbit.Delivery) {
+	pos := len(q.messages)
+
+	if q.args.maxPriority > 0 {
+		p := q.priority(d)
+
+		// messages are sorted by descending priority
+		pos = sort.Search(len(q.messages), func(i int) bool {
+			return q.priority(q.messages[i]) < p
+		})
+	}
+
+	q.messages = append(q.messages, nil)
+	copy(q.messages[pos+1:], q.messages[pos:])
+	q.messages[pos] = d
+	q.bytes += len(d.Body())
+}
+
+// priority returns the priority of d clamped to x-max-priority
+func (q *Queue) priority(d wabbit.Delivery) uint8 {
+	if p := d.Priority(); p < q.args.maxPriority {
+		return p
+	}
+
+	return q.args.maxPriority
+}
+
+// pop removes the message in the head of the queue
+func (q *Queue) pop() (wabbit.Delivery, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.messages) == 0 {
+		return nil, false
+	}
+
+	return q.shift(), true
+}
+
+// get removes the message in the head of the queue and returns the
+// number of messages remaining.
+func (q *Queue) get() (wabbit.Delivery, int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.touch()
+
+	if len(q.messages) == 0 {
+		return nil, 0, false
+	}
+
+	return q.shift(), len(q.messages), true
+}
+
+func (q *Queue) shift() wabbit.Delivery {
+	d := q.messages[0]
+	q.messages[0] = nil
+	q.messages = q.messages[1:]
+	q.bytes -= len(d.Body())
+
+	return d
+}
+
+// purge removes every ready message and returns how many were removed
+func (q *Queue) purge() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := len(q.messages)
+	q.messages = make([]wabbit.Delivery, 0)
+	q.bytes = 0
+
+	return n
+}
+
+func (q *Queue) subscribe(c *consumer) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.consumers = append(q.consumers, c)
+	q.touch()
+	q.dispatch()
+}
+
+// unsubscribe removes c from the consumers and reports if the queue is
+// to be auto-deleted, because c was its last consumer.
+func (q *Queue) unsubscribe(c *consumer) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	found := false
+
+	for i, sub := range q.consumers {
+		if sub == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+
+			if i < q.next {
+				q.next--
+			}
+
+			found = true
+			break
+		}
+	}
+
+	q.touch()
+
+	return found && q.flags.autoDelete && len(q.consumers) == 0
+}
+
+// unsubscribeAll removes and returns every consumer of the queue
+func (q *Queue) unsubscribeAll() []*consumer {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	consumers := q.consumers
+	q.consumers, q.next = nil, 0
+
+	return consumers
+}
+
+// resume dispatches the ready messages after consumers got credit back
+func (q *Queue) resume() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.dispatch()
+}
+
+// dispatch hands the ready messages to the consumers in round-robin,
+// skipping the consumers without prefetch credit. Must be called with
+// q.mu held.
+func (q *Queue) dispatch() {
+	for len(q.messages) > 0 && len(q.consumers) > 0 {
+		served := false
+
+		for i := 0; i < len(q.consumers); i++ {
+			idx := (q.next + i) % len(q.consumers)
+			c := q.consumers[idx]
+
+			if !c.channel.acquire(c) {
+				continue
+			}
+
+			c.enqueue(q.shift())
+			q.next = (idx + 1) % len(q.consumers)
+			served = true
+			break
+		}
+
+		if !served {
+			return
+		}
+	}
+}
+
+// touch marks the queue as used now, postponing its x-expires. Must be
+// called with q.mu held.
+func (q *Queue) touch() {
+	if q.vhost == nil || q.args.expires == 0 {
+		return
+	}
+
+	q.lastUsed = q.clock.Now()
+
+	if len(q.consumers) == 0 {
+		q.schedule(q.lastUsed.Add(q.args.expires))
+	}
+}
+
+// unused reports if the queue expired by x-expires at now
+func (q *Queue) unused(now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.args.expires > 0 && len(q.consumers) == 0 &&
+		!now.Before(q.lastUsed.Add(q.args.expires))
+}
+
+// schedule arms the expiry timer of the queue for the deadline t unless
+// an earlier timer is armed. Must be called with q.mu held.
+func (q *Queue) schedule(t time.Time) {
+	if !q.timerAt.IsZero() && !t.Before(q.timerAt) {
+		return
+	}
+
+	q.timerAt = t
+
+	v := q.vhost
+	q.clock.AfterFunc(t.Sub(q.clock.Now()), func() {
+		v.expire(q)
+	})
+}
+
+// expired removes and returns the messages expired at now, then arms the
+// timer for the next expiry.
+func (q *Queue) expired(now time.Time) []wabbit.Delivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var (
+		expired []wabbit.Delivery
+		next    time.Time
+	)
+
+	kept := q.messages[:0]
+
+	for _, d := range q.messages {
+		qd, ok := d.(*Delivery)
+
+		switch {
+		case !ok || qd.expires.IsZero():
+			kept = append(kept, d)
+		case !now.Before(qd.expires):
+			expired = append(expired, d)
+			q.bytes -= len(d.Body())
+		default:
+			kept = append(kept, d)
+
+			if next.IsZero() || qd.expires.Before(next) {
+				next = qd.expires
+			}
+		}
+	}
+
+	for i := len(kept); i < len(q.messages); i++ {
+		q.messages[i] = nil
+	}
+
+	q.messages = kept
+	q.timerAt = time.Time{}
+
+	if q.args.expires > 0 && len(q.consumers) == 0 {
+		if deadline := q.lastUsed.Add(q.args.expires); next.IsZero() || deadline.Before(next) {
+			next = deadline
+		}
+	}
+
+	if !next.IsZero() {
+		q.schedule(next)
+	}
+
+	return expired
 }
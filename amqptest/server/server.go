@@ -3,6 +3,7 @@ package server
 import (
 	"errors"
 	"fmt"
+	"net"
 	"sync"
 
 	"github.com/NeowayLabs/wabbit"
@@ -33,6 +34,10 @@ type AMQPServer struct {
 	channels    map[string][]*Channel
 	vhost       *VHost
 	muChannels  *sync.RWMutex
+
+	listener  net.Listener
+	wireConns map[*wireConn]struct{}
+	muWire    *sync.Mutex // Protects listener and wireConns
 }
 
 // NewServer returns a new fake amqp server
@@ -43,11 +48,33 @@ func newServer(amqpuri string) *AMQPServer {
 		channels:    make(map[string][]*Channel),
 		vhost:       NewVHost("/"),
 		muChannels:  &sync.RWMutex{},
+		wireConns:   make(map[*wireConn]struct{}),
+		muWire:      &sync.Mutex{},
 	}
 }
 
 // CreateChannel returns a new fresh channel
 func (s *AMQPServer) CreateChannel(connID string, conn wabbit.Conn) (wabbit.Channel, error) {
+	ch, err := s.addChannel(connID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tempCh := make(chan wabbit.Error)
+	conn.NotifyClose(tempCh)
+	go func() {
+		for err := range tempCh {
+			ch.errSpread.Write(err)
+		}
+		close(tempCh)
+	}()
+
+	return ch, nil
+}
+
+// addChannel creates a channel owned by the connection connID
+func (s *AMQPServer) addChannel(connID string) (*Channel, error) {
 	s.muChannels.Lock()
 	defer s.muChannels.Unlock()
 
@@ -63,22 +90,22 @@ func (s *AMQPServer) CreateChannel(connID string, conn wabbit.Conn) (wabbit.Chan
 	}
 
 	ch := NewChannel(s.vhost)
+	ch.connID = connID
 
 	channels = append(channels, ch)
 	s.channels[connID] = channels
 
-	tempCh := make(chan wabbit.Error)
-	conn.NotifyClose(tempCh)
-	go func() {
-		for err := range tempCh {
-			ch.errSpread.Write(err)
-		}
-		close(tempCh)
-	}()
-
 	return ch, nil
 }
 
+// delChannels forgets every channel owned by the connection connID
+func (s *AMQPServer) delChannels(connID string) {
+	s.muChannels.Lock()
+	defer s.muChannels.Unlock()
+
+	delete(s.channels, connID)
+}
+
 // Start a new AMQP server fake-listening on host:port
 func (s *AMQPServer) Start() error {
 	mu.Lock()
@@ -88,8 +115,23 @@ func (s *AMQPServer) Start() error {
 	return nil
 }
 
-// Stop the fake server
+// NackPublishes makes the server nack the publisher confirms of the
+// messages for which fn returns true. See VHost.NackPublishes.
+func (s *AMQPServer) NackPublishes(fn func(exchange, key string, body []byte) bool) {
+	s.vhost.NackPublishes(fn)
+}
+
+// SetClock replaces the clock of the message TTLs and queue expiry. See
+// VHost.SetClock.
+func (s *AMQPServer) SetClock(c Clock) {
+	s.vhost.SetClock(c)
+}
+
+// Stop the fake server. If the server is listening on TCP, the listener
+// is closed and every client connection is forced to close.
 func (s *AMQPServer) Stop() error {
+	s.stopListener()
+
 	mu.Lock()
 	defer mu.Unlock()
 
@@ -106,11 +148,13 @@ func (s *AMQPServer) Stop() error {
 
 	s.notifyChans = make(map[string]*utils.ErrBroadcast)
 
+	s.muChannels.RLock()
 	for _, chanMap := range s.channels {
 		for _, eachChan := range chanMap {
 			eachChan.Close()
 		}
 	}
+	s.muChannels.RUnlock()
 
 	return nil
 }
@@ -175,5 +219,6 @@ func Close(amqpuri string, connID string) error {
 	}
 
 	amqpServer.delNotify(connID)
+	amqpServer.vhost.deleteExclusive(connID)
 	return nil
 }
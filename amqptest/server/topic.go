@@ -0,0 +1,159 @@
+package server
+
+import (
+	"sort"
+	"strings"
+)
+
+type (
+	// topicTrie indexes topic bindings by the words of their binding
+	// keys, then routing a message costs a walk on the matching branches
+	// instead of testing every binding.
+	topicTrie struct {
+		root *topicNode
+		seq  uint64
+	}
+
+	topicNode struct {
+		children map[string]*topicNode
+		bindings []topicBinding
+	}
+
+	topicBinding struct {
+		seq uint64 // order of binding, keeps routing deterministic
+		id  bindingID
+		b   *BindingsMap
+	}
+)
+
+func newTopicTrie() *topicTrie {
+	return &topicTrie{root: newTopicNode()}
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{children: make(map[string]*topicNode)}
+}
+
+// add binds b with the binding key. Binding the same queue again with
+// the same key and arguments is a no-op.
+func (t *topicTrie) add(key string, b *BindingsMap) {
+	node := t.root
+
+	for _, word := range strings.Split(key, ".") {
+		child, ok := node.children[word]
+
+		if !ok {
+			child = newTopicNode()
+			node.children[word] = child
+		}
+
+		node = child
+	}
+
+	id := newBindingID(key, b)
+
+	for _, tb := range node.bindings {
+		if tb.id == id {
+			return
+		}
+	}
+
+	t.seq++
+	node.bindings = append(node.bindings, topicBinding{t.seq, id, b})
+}
+
+// del removes the binding of b with the binding key and prunes the empty
+// branches. Other queues bound with the same key are kept.
+func (t *topicTrie) del(key string, b *BindingsMap) {
+	t.root.del(strings.Split(key, "."), newBindingID(key, b))
+}
+
+func (n *topicNode) del(words []string, id bindingID) bool {
+	if len(words) == 0 {
+		for i, tb := range n.bindings {
+			if tb.id == id {
+				n.bindings = append(n.bindings[:i], n.bindings[i+1:]...)
+				break
+			}
+		}
+	} else if child, ok := n.children[words[0]]; ok && child.del(words[1:], id) {
+		delete(n.children, words[0])
+	}
+
+	return len(n.bindings) == 0 && len(n.children) == 0
+}
+
+// unbindQueue removes the bindings of q and reports if the node became
+// empty, then the caller prunes it.
+func (n *topicNode) unbindQueue(q *Queue) bool {
+	kept := n.bindings[:0]
+
+	for _, tb := range n.bindings {
+		if tb.b.queue != q {
+			kept = append(kept, tb)
+		}
+	}
+
+	n.bindings = kept
+
+	for word, child := range n.children {
+		if child.unbindQueue(q) {
+			delete(n.children, word)
+		}
+	}
+
+	return len(n.bindings) == 0 && len(n.children) == 0
+}
+
+// empty reports if there is no binding, the empty branches are pruned
+func (t *topicTrie) empty() bool {
+	return len(t.root.bindings) == 0 && len(t.root.children) == 0
+}
+
+// match returns the bindings matching the routing key in the order they
+// were bound. Each queue is returned only once.
+func (t *topicTrie) match(route string) []*BindingsMap {
+	var found []topicBinding
+
+	t.root.match(strings.Split(route, "."), &found)
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].seq < found[j].seq
+	})
+
+	seen := make(map[*Queue]bool, len(found))
+	matches := make([]*BindingsMap, 0, len(found))
+
+	for _, tb := range found {
+		if seen[tb.b.queue] {
+			continue
+		}
+
+		seen[tb.b.queue] = true
+		matches = append(matches, tb.b)
+	}
+
+	return matches
+}
+
+// match follows the branches matching words: '*' matches exactly one
+// word and '#' matches zero or more words.
+func (n *topicNode) match(words []string, found *[]topicBinding) {
+	if len(words) == 0 {
+		*found = append(*found, n.bindings...)
+	} else {
+		if child, ok := n.children[words[0]]; ok {
+			child.match(words[1:], found)
+		}
+
+		if child, ok := n.children["*"]; ok {
+			child.match(words[1:], found)
+		}
+	}
+
+	if child, ok := n.children["#"]; ok {
+		for i := 0; i <= len(words); i++ {
+			child.match(words[i:], found)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/NeowayLabs/wabbit"
+	"github.com/NeowayLabs/wabbit/utils"
+)
+
+type (
+	// txPublish is a publish buffered by the channel transaction
+	txPublish struct {
+		exc, route string
+		msg        []byte
+		opt        wabbit.Option
+		mandatory  bool
+		d          *Delivery
+	}
+
+	// txAck is an ack, nack or reject buffered by the channel transaction
+	txAck struct {
+		tag               uint64
+		multiple, requeue bool
+		ack               bool
+	}
+)
+
+// Tx puts the channel in transactional mode. Publishes, acks, nacks and
+// rejects are buffered until TxCommit or TxRollback.
+func (ch *Channel) Tx() error {
+	if err := ch.notOpen(); err != nil {
+		return err
+	}
+
+	ch.muTx.Lock()
+	confirm := ch.confirm
+
+	if !confirm {
+		ch.tx = true
+	}
+
+	ch.muTx.Unlock()
+
+	if confirm {
+		return ch.exception(utils.NewError(utils.PreconditionFailed,
+			"PRECONDITION_FAILED - cannot switch from confirm to tx mode",
+			true, false))
+	}
+
+	return nil
+}
+
+// TxCommit applies the buffered publishes atomically to the VHost, then
+// the buffered acks, nacks and rejects.
+func (ch *Channel) TxCommit() error {
+	if err := ch.notOpen(); err != nil {
+		return err
+	}
+
+	return ch.exception(ch.txCommit())
+}
+
+func (ch *Channel) txCommit() error {
+	publishes, acks, err := ch.endTx()
+
+	if err != nil {
+		return err
+	}
+
+	// the only sender of returns while committing
+	ch.publishing <- struct{}{}
+	defer func() { <-ch.publishing }()
+
+	ch.VHost.mu.Lock()
+
+	for _, p := range publishes {
+		if _, ok := ch.exchanges[p.exc]; !ok {
+			ch.VHost.mu.Unlock()
+			return utils.NewError(utils.NotFound,
+				fmt.Sprintf("NOT_FOUND - no exchange '%s' in vhost '%s'", p.exc, ch.name),
+				true, false)
+		}
+	}
+
+	routed := make([]routing, len(publishes))
+
+	for i, p := range publishes {
+		r, perr := ch.VHost.publish(p.exc, p.route, p.d, nil)
+
+		if perr != nil && err == nil {
+			err = perr
+		}
+
+		routed[i] = r
+	}
+
+	ch.VHost.mu.Unlock()
+
+	for i, p := range publishes {
+		if routed[i].queues == 0 && p.mandatory {
+			ch.notifyReturn(wabbit.Return{
+				ReplyCode:  utils.NoRoute,
+				ReplyText:  "NO_ROUTE",
+				Exchange:   p.exc,
+				RoutingKey: p.route,
+				Body:       p.msg,
+				Properties: returnProperties(p.opt),
+			})
+		}
+	}
+
+	for _, a := range acks {
+		var aerr error
+
+		if a.ack {
+			aerr = ch.ack(a.tag, a.multiple)
+		} else {
+			aerr = ch.nack(a.tag, a.multiple, a.requeue)
+		}
+
+		if aerr != nil && err == nil {
+			err = aerr
+		}
+	}
+
+	return err
+}
+
+// TxRollback discards the buffered publishes, acks, nacks and rejects.
+// The messages delivered to the channel stay unacked.
+func (ch *Channel) TxRollback() error {
+	if err := ch.notOpen(); err != nil {
+		return err
+	}
+
+	_, _, err := ch.endTx()
+	return ch.exception(err)
+}
+
+// endTx returns and clears the buffers of the transaction
+func (ch *Channel) endTx() ([]txPublish, []txAck, error) {
+	ch.muTx.Lock()
+	defer ch.muTx.Unlock()
+
+	if !ch.tx {
+		return nil, nil, utils.NewError(utils.PreconditionFailed,
+			"PRECONDITION_FAILED - channel is not transactional",
+			true, false)
+	}
+
+	publishes, acks := ch.txPublishes, ch.txAcks
+	ch.txPublishes, ch.txAcks = nil, nil
+
+	return publishes, acks, nil
+}
+
+// bufferPublish buffers p if the channel is transactional. Otherwise it
+// reports if the channel is in confirm mode.
+func (ch *Channel) bufferPublish(p txPublish) (buffered, confirm bool) {
+	ch.muTx.Lock()
+	defer ch.muTx.Unlock()
+
+	if !ch.tx {
+		return false, ch.confirm
+	}
+
+	ch.txPublishes = append(ch.txPublishes, p)
+	return true, false
+}
+
+// bufferAck buffers a if the channel is transactional. The delivery tag
+// is checked when buffered.
+func (ch *Channel) bufferAck(a txAck) (bool, error) {
+	ch.muTx.Lock()
+	defer ch.muTx.Unlock()
+
+	if !ch.tx {
+		return false, nil
+	}
+
+	if !ch.hasUnacked(a.tag, a.multiple) {
+		return true, unknownDeliveryTag(a.tag)
+	}
+
+	ch.txAcks = append(ch.txAcks, a)
+	return true, nil
+}
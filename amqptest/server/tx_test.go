@@ -0,0 +1,133 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTxCommitAndRollback(t *testing.T) {
+	vh := NewVHost("/")
+
+	ch := NewChannel(vh)
+
+	q, err := ch.QueueDeclare("billing", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ch.TxCommit(); err == nil {
+		t.Errorf("TxCommit shall fail on a channel not transactional")
+		return
+	}
+
+	// closed by the PRECONDITION_FAILED exception
+	ch = NewChannel(vh)
+
+	err = ch.Tx()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, body := range []string{"1", "2"} {
+		if err = ch.Publish("", q.Name(), []byte(body), nil); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	if q.Messages() != 0 {
+		t.Errorf("Publishes shall be buffered until commit: %d", q.Messages())
+		return
+	}
+
+	err = ch.TxRollback()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ch.TxCommit()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if q.Messages() != 0 {
+		t.Errorf("Rolled back publishes shall be discarded: %d", q.Messages())
+		return
+	}
+
+	for _, body := range []string{"1", "2"} {
+		if err = ch.Publish("", q.Name(), []byte(body), nil); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	err = ch.TxCommit()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if q.Messages() != 2 {
+		t.Errorf("Committed publishes not routed: %d", q.Messages())
+		return
+	}
+
+	deliveries, err := ch.Consume(q.Name(), "", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case d := <-deliveries:
+			if err = d.Ack(false); err != nil {
+				t.Error(err)
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Committed message not delivered")
+			return
+		}
+	}
+
+	if err = ch.TxRollback(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(ch.unacked) != 2 {
+		t.Errorf("Rolled back acks shall keep the messages unacked: %d", len(ch.unacked))
+		return
+	}
+
+	if err = ch.Ack(1<<63, true); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ch.TxCommit(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(ch.unacked) != 0 {
+		t.Errorf("Committed acks not applied: %d", len(ch.unacked))
+		return
+	}
+
+	if err = ch.Confirm(false); err == nil {
+		t.Errorf("Confirm shall fail on a transactional channel")
+	}
+}
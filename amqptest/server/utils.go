@@ -1,115 +1,150 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
 	"strings"
+
+	"github.com/NeowayLabs/wabbit"
+	"github.com/NeowayLabs/wabbit/utils"
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-// matchs r2 against r1 following the AMQP rules for topic routing keys
+// matchs r2 against r1 following the AMQP rules for topic routing keys:
+// words are separated by dots, '*' matches exactly one word and '#'
+// matches zero or more words.
 func topicMatch(r1, r2 string) bool {
-	var match bool
+	t := newTopicTrie()
+	t.add(r1, &BindingsMap{queue: &Queue{}})
+
+	return len(t.match(r2)) > 0
+}
 
-	bparts := strings.Split(r1, ".")
-	rparts := strings.Split(r2, ".")
+// bindingArgs returns the "args" option of QueueDeclare, QueueBind and
+// QueueUnbind
+func bindingArgs(options wabbit.Option) (wabbit.Option, error) {
+	v, ok := options["args"]
 
-	if len(rparts) > len(bparts) {
-		return false
+	if !ok || v == nil {
+		return nil, nil
 	}
 
-outer:
-	for i := 0; i < len(bparts); i++ {
-		bp := bparts[i]
-		rp := rparts[i]
+	switch args := v.(type) {
+	case amqp.Table:
+		return wabbit.Option(args), nil
+	case wabbit.Option:
+		return args, nil
+	case map[string]interface{}:
+		return wabbit.Option(args), nil
+	}
 
-		if len(bp) == 0 {
-			return false
-		}
+	return nil, errors.New("args is of type amqp.Table")
+}
 
-		var bsi, rsi int
-
-		for rsi < len(rp) {
-			// fmt.Printf("Testing '%c' and '%c'\n", bp[bsi], rp[rsi])
-
-			// The char '#' matchs none or more chars (everything that is on rp[rsi])
-			// next char, move on
-			if bp[bsi] == '#' {
-				match = true
-				continue outer
-			} else if bp[bsi] == '*' {
-				// The '*' matchs only one character, then if it's the last char of binding part
-				// and isn't the last char of rp, then surely it don't match.
-				if bsi == len(bp)-1 && rsi < len(rp)-1 {
-					match = false
-					break outer
-				}
-
-				match = true
-
-				if bsi < len(bp)-1 {
-					bsi++
-				}
-
-				rsi++
-			} else if bp[bsi] == rp[rsi] {
-				// if it's the last char of binding part and it isn't an '*' or '#',
-				// and it isn't the last char of rp, then we can stop here
-				// because sure that route don't match the binding
-				if bsi == len(bp)-1 && rsi < len(rp)-1 {
-					match = false
-					break outer
-				}
-
-				if bsi < len(bp)-1 {
-					bsi++
-				}
-
-				rsi++
-
-				match = true
-			} else {
-				match = false
-				break outer
-			}
-		}
+// headersMatchMode returns the x-match mode of the headers binding
+// arguments, "all" or "any", and if the arguments starting with x- are
+// compared too, as in "any-with-x" and "all-with-x". Without x-match the
+// binding behaves as "all".
+func headersMatchMode(args wabbit.Option) (string, bool, error) {
+	val, ok := args["x-match"]
 
+	if !ok {
+		return "all", false, nil
 	}
 
-	return match
+	str, _ := val.(string)
+
+	switch mode := strings.ToLower(str); mode {
+	case "any", "all":
+		return mode, false, nil
+	case "any-with-x", "all-with-x":
+		return strings.TrimSuffix(mode, "-with-x"), true, nil
+	}
+
+	return "", false, utils.NewError(utils.PreconditionFailed,
+		fmt.Sprintf("PRECONDITION_FAILED - invalid x-match field value %v; expected all, any, all-with-x or any-with-x", val),
+		true, false)
 }
 
-// match the message headers with the bindings depending on the x-match value and ignorint headers starting with x-
-func headersMatch(b *BindingsMap, d *Delivery) (bool, error) {
-	var cmpType string
-	var init bool
+// match the message headers with the binding arguments depending on the
+// x-match mode, see headersMatchMode. The x-match of the bindings is
+// checked by QueueBind.
+func headersMatch(b *BindingsMap, d *Delivery) bool {
+	cmpType, withX, err := headersMatchMode(b.headers)
 
-	if val, ok := b.headers["x-match"]; ok {
-		cmpType = strings.ToLower(val)
-		if cmpType != "any" && cmpType != "all" {
-			return false, fmt.Errorf("x-match binding should be set to \"any\" or \"all\" values. got: %s", cmpType)
-		}
-	} else {
-		// when there is no x-match header messages are fanout to all the bindings
-		return true, nil
+	if err != nil {
+		return false
 	}
 
 	// If it is all the base boolean flag iteration value is true, if it is any is false
 	// To simplify the return if all the iteration completes
-	init = cmpType == "all"
+	init := cmpType == "all"
 
 	for key, val := range b.headers {
-		if !strings.HasPrefix(key, "x-") {
-			switch cmpType {
-			case "any":
-				if d.headers[key] == val {
-					return true, nil
-				}
-			case "all":
-				if d.headers[key] != val {
-					return false, nil
-				}
+		if key == "x-match" || (!withX && strings.HasPrefix(key, "x-")) {
+			continue
+		}
+
+		hdr, ok := d.headers[key]
+		match := ok && headerEqual(val, hdr)
+
+		switch cmpType {
+		case "any":
+			if match {
+				return true
+			}
+		case "all":
+			if !match {
+				return false
 			}
 		}
 	}
 
-	return init, nil
+	return init
+}
+
+// headerEqual compares a binding argument with a message header. A nil
+// argument matches any value of the header. Numbers are compared by
+// value whatever their integer or float type, any other type must match.
+func headerEqual(arg, hdr interface{}) bool {
+	if arg == nil {
+		return true
+	}
+
+	if a, ok := headerNumber(arg); ok {
+		h, ok := headerNumber(hdr)
+		return ok && a == h
+	}
+
+	return reflect.DeepEqual(arg, hdr)
+}
+
+func headerNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+
+	return 0, false
 }
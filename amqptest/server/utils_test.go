@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/NeowayLabs/wabbit"
+	"github.com/NeowayLabs/wabbit/utils"
 )
 
 func matchSuccess(t *testing.T, b, r string, expected bool) {
@@ -24,23 +25,35 @@ func TestTopicMatch(t *testing.T) {
 		{"ab", "ab", true},
 		{"#", "a", true},
 		{"#", "aa", true},
-		{"#", "aaaaaaaaaaaaaaaaaaaaaaaaa", true},
+		{"#", "a.b.c", true},
+		{"#", "", true},
+		{"#.a", "a", true},
 		{"#.a", "bbbb.a", true},
-		{"teste#", "testeb", true},
-		{"teste#", "testebbbbbbbbbbb", true},
+		{"#.a", "b.c.a", true},
+		{"a.#", "a", true},
+		{"a.#.b", "a.b", true},
+		{"a.#.b", "a.x.y.b", true},
+		{"*", "aa", true},
+		{"*", "", true},
 		{"*.*", "a.b", true},
-		{"*a", "aa", true},
-		{"*aa", "baa", true},
-		{"a*.b*", "ab.ba", true},
+		{"*.b.#", "a.b", true},
+		{"#.*", "a", true},
 		{"maps.layer.stored", "maps.layer.stored", true},
 		{"maps.layer.#", "maps.layer.bleh", true},
+		{"maps.layer.*", "maps.layer.stored", true},
+		{"maps.*.stored", "maps.layer.stored", true},
 
 		// FAIL
 		{"", "a", false},
 		{"a", "b", false},
-		{"*", "aa", false},
-		{"a*", "aaa", false},
-		{"maps.layer.*", "maps.layer.stored", false},
+		{"*", "a.b", false},
+		{"*.*", "a", false},
+		{"a.#.b", "a.x.c", false},
+		{"teste#", "testeb", false},
+		{"*a", "aa", false},
+		{"a*.b*", "ab.ba", false},
+		{"maps.layer.*", "maps.layer", false},
+		{"maps.layer.*", "maps.layer.stored.data", false},
 	} {
 		matchSuccess(t, pair.b, pair.r, pair.ok)
 	}
@@ -49,36 +62,39 @@ func TestTopicMatch(t *testing.T) {
 func TestHeadersMatch(t *testing.T) {
 	q := NewQueue("test")
 	for _, tt := range []struct {
-		name         string
-		b            BindingsMap
-		d            Delivery
-		expected, ok bool
+		name     string
+		b        BindingsMap
+		d        Delivery
+		expected bool
 	}{
 		// OK
-		{"no headers exchange nor message", BindingsMap{queue: q, headers: map[string]string{}}, Delivery{headers: wabbit.Option{}}, true, true},
-		{"no headers exchange headers in message", BindingsMap{queue: q, headers: map[string]string{}}, Delivery{headers: wabbit.Option{"test": "test"}}, true, true},
-		{"just x-match header set to all in exchange no headers in message", BindingsMap{queue: q, headers: map[string]string{"x-match": "all"}}, Delivery{headers: wabbit.Option{}}, true, true},
-		{"all headers in exchange and message", BindingsMap{queue: q, headers: map[string]string{"x-match": "all", "test": "test"}}, Delivery{headers: wabbit.Option{"test": "test"}}, true, true},
-		{"ignoring all \"x-\" prefixed headers", BindingsMap{queue: q, headers: map[string]string{"x-match": "all", "x-test": "test"}}, Delivery{headers: wabbit.Option{"x-test": "test"}}, true, true},
-		{"any headers in exchange and message", BindingsMap{queue: q, headers: map[string]string{"x-match": "any", "test": "test", "test2": "test"}}, Delivery{headers: wabbit.Option{"test": "test"}}, true, true},
+		{"no headers exchange nor message", BindingsMap{queue: q, headers: wabbit.Option{}}, Delivery{headers: wabbit.Option{}}, true},
+		{"no headers exchange headers in message", BindingsMap{queue: q, headers: wabbit.Option{}}, Delivery{headers: wabbit.Option{"test": "test"}}, true},
+		{"just x-match header set to all in exchange no headers in message", BindingsMap{queue: q, headers: wabbit.Option{"x-match": "all"}}, Delivery{headers: wabbit.Option{}}, true},
+		{"all headers in exchange and message", BindingsMap{queue: q, headers: wabbit.Option{"x-match": "all", "test": "test"}}, Delivery{headers: wabbit.Option{"test": "test"}}, true},
+		{"ignoring all \"x-\" prefixed headers", BindingsMap{queue: q, headers: wabbit.Option{"x-match": "all", "x-test": "test"}}, Delivery{headers: wabbit.Option{"x-test": "test"}}, true},
+		{"any headers in exchange and message", BindingsMap{queue: q, headers: wabbit.Option{"x-match": "any", "test": "test", "test2": "test"}}, Delivery{headers: wabbit.Option{"test": "test"}}, true},
+		{"no x-match behaves as all", BindingsMap{queue: q, headers: wabbit.Option{"test": "test"}}, Delivery{headers: wabbit.Option{"test": "test"}}, true},
+		{"typed values in exchange and message", BindingsMap{queue: q, headers: wabbit.Option{"x-match": "all", "count": int32(5), "ok": true}}, Delivery{headers: wabbit.Option{"count": int64(5), "ok": true}}, true},
+		{"void value matches any header value", BindingsMap{queue: q, headers: wabbit.Option{"x-match": "all", "test": nil}}, Delivery{headers: wabbit.Option{"test": 42}}, true},
+		{"all-with-x compares \"x-\" prefixed headers", BindingsMap{queue: q, headers: wabbit.Option{"x-match": "all-with-x", "x-test": "test"}}, Delivery{headers: wabbit.Option{"x-test": "test"}}, true},
+		{"any-with-x compares \"x-\" prefixed headers", BindingsMap{queue: q, headers: wabbit.Option{"x-match": "any-with-x", "x-test": "test", "test": "test"}}, Delivery{headers: wabbit.Option{"x-test": "test"}}, true},
 
 		// FAIL
-		{"wrong x-match header value in bindings", BindingsMap{queue: q, headers: map[string]string{"x-match": "test"}}, Delivery{headers: wabbit.Option{}}, false, false},
-		{"just x-match header set to any in exchange no headers message message", BindingsMap{queue: q, headers: map[string]string{"x-match": "any"}}, Delivery{headers: wabbit.Option{}}, false, true},
-		{"all headers in exchange no headers in message", BindingsMap{queue: q, headers: map[string]string{"x-match": "all", "test": "test"}}, Delivery{headers: wabbit.Option{}}, false, true},
-		{"all headers in exchange some headers in message", BindingsMap{queue: q, headers: map[string]string{"x-match": "all", "test": "test", "test2": "test"}}, Delivery{headers: wabbit.Option{"test": "test"}}, false, true},
-		{"any headers in exchange and no match in message", BindingsMap{queue: q, headers: map[string]string{"x-match": "any", "test": "test"}}, Delivery{headers: wabbit.Option{"test2": "test"}}, false, true},
-		{"ignoring any \"x-\" prefixed headers", BindingsMap{queue: q, headers: map[string]string{"x-match": "any", "x-test": "test"}}, Delivery{headers: wabbit.Option{"x-test": "test"}}, false, true},
-		{"any headers in exchange and no match in message", BindingsMap{queue: q, headers: map[string]string{"x-match": "any", "test": "test"}}, Delivery{headers: wabbit.Option{"test2": "test"}}, false, true},
+		{"just x-match header set to any in exchange no headers message message", BindingsMap{queue: q, headers: wabbit.Option{"x-match": "any"}}, Delivery{headers: wabbit.Option{}}, false},
+		{"all headers in exchange no headers in message", BindingsMap{queue: q, headers: wabbit.Option{"x-match": "all", "test": "test"}}, Delivery{headers: wabbit.Option{}}, false},
+		{"all headers in exchange some headers in message", BindingsMap{queue: q, headers: wabbit.Option{"x-match": "all", "test": "test", "test2": "test"}}, Delivery{headers: wabbit.Option{"test": "test"}}, false},
+		{"any headers in exchange and no match in message", BindingsMap{queue: q, headers: wabbit.Option{"x-match": "any", "test": "test"}}, Delivery{headers: wabbit.Option{"test2": "test"}}, false},
+		{"typed values differ", BindingsMap{queue: q, headers: wabbit.Option{"x-match": "all", "count": int32(5)}}, Delivery{headers: wabbit.Option{"count": "5"}}, false},
+		{"void value needs the header", BindingsMap{queue: q, headers: wabbit.Option{"x-match": "any", "test": nil}}, Delivery{headers: wabbit.Option{}}, false},
+		{"all-with-x mismatch in \"x-\" prefixed headers", BindingsMap{queue: q, headers: wabbit.Option{"x-match": "all-with-x", "x-test": "test", "test": "test"}}, Delivery{headers: wabbit.Option{"test": "test"}}, false},
+		{"ignoring any \"x-\" prefixed headers", BindingsMap{queue: q, headers: wabbit.Option{"x-match": "any", "x-test": "test"}}, Delivery{headers: wabbit.Option{"x-test": "test"}}, false},
+		{"any headers in exchange and no match in message", BindingsMap{queue: q, headers: wabbit.Option{"x-match": "any", "test": "test"}}, Delivery{headers: wabbit.Option{"test2": "test"}}, false},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
 			tt := tt
 			t.Parallel()
-			res, err := headersMatch(&tt.b, &tt.d)
-
-			if !tt.ok && err == nil {
-				t.Errorf("expected error but got none")
-			}
+			res := headersMatch(&tt.b, &tt.d)
 
 			if res != tt.expected {
 				t.Errorf("expected '%v' got '%v'", tt.expected, res)
@@ -86,3 +102,27 @@ func TestHeadersMatch(t *testing.T) {
 		})
 	}
 }
+
+func TestHeadersMatchMode(t *testing.T) {
+	for _, args := range []wabbit.Option{
+		{"x-match": "test"},
+		{"x-match": 1},
+		{"x-match": ""},
+	} {
+		_, _, err := headersMatchMode(args)
+
+		if e, ok := err.(wabbit.Error); !ok || e.Code() != utils.PreconditionFailed {
+			t.Errorf("Invalid x-match %v shall fail with PRECONDITION_FAILED: %v", args["x-match"], err)
+		}
+	}
+
+	for _, args := range []wabbit.Option{
+		nil,
+		{"x-match": "all"},
+		{"x-match": "any-with-x"},
+	} {
+		if _, _, err := headersMatchMode(args); err != nil {
+			t.Errorf("Valid x-match %v: %v", args["x-match"], err)
+		}
+	}
+}
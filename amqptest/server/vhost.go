@@ -1,10 +1,16 @@
 package server
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/NeowayLabs/wabbit"
+	"github.com/NeowayLabs/wabbit/utils"
+	"github.com/pborman/uuid"
 )
 
 // VHost is a fake AMQP virtual host
@@ -13,6 +19,64 @@ type VHost struct {
 	mu        sync.Mutex // Protects exchanges and queues.
 	exchanges map[string]Exchange
 	queues    map[string]*Queue
+
+	// declarations of the exchanges, compared with the redeclarations
+	exchangeDecls map[string]exchangeDecl
+
+	nackHook func(exchange, key string, body []byte) bool
+	clock    Clock
+}
+
+// exchangeDecl is the kind, flags and arguments of a declared exchange
+type exchangeDecl struct {
+	kind       string
+	durable    bool
+	autoDelete bool
+	internal   bool
+	args       wabbit.Option
+}
+
+// exchangeEquivalenceArgs are the exchange arguments that a redeclaration
+// must repeat, as in RabbitMQ.
+var exchangeEquivalenceArgs = []string{
+	"alternate-exchange",
+}
+
+// parseExchangeDecl returns the declaration of an exchange of the kind
+// with the options opt.
+func parseExchangeDecl(kind string, opt wabbit.Option) (exchangeDecl, error) {
+	var (
+		decl = exchangeDecl{kind: kind}
+		ok   bool
+	)
+
+	if v, found := opt["durable"]; found {
+		if decl.durable, ok = v.(bool); !ok {
+			return decl, errors.New("durable option is of type bool")
+		}
+	}
+
+	if v, found := opt["autoDelete"]; found {
+		if decl.autoDelete, ok = v.(bool); !ok {
+			return decl, errors.New("autoDelete option is of type bool")
+		}
+	}
+
+	if v, found := opt["internal"]; found {
+		if decl.internal, ok = v.(bool); !ok {
+			return decl, errors.New("internal option is of type bool")
+		}
+	}
+
+	args, err := bindingArgs(opt)
+
+	if err != nil {
+		return decl, err
+	}
+
+	decl.args = args
+
+	return decl, nil
 }
 
 // NewVHost create a new fake AMQP Virtual Host
@@ -21,6 +85,7 @@ func NewVHost(name string) *VHost {
 		name:      name,
 		queues:    make(map[string]*Queue),
 		exchanges: make(map[string]Exchange),
+		clock:     systemClock{},
 	}
 
 	vh.createDefaultExchanges()
@@ -31,12 +96,23 @@ func (v *VHost) createDefaultExchanges() {
 	exchs := make(map[string]Exchange)
 	exchs["amq.topic"] = NewTopicExchange("amq.topic")
 	exchs["amq.direct"] = NewDirectExchange("amq.direct")
+	exchs["amq.fanout"] = NewFanoutExchange("amq.fanout")
 	exchs["topic"] = NewTopicExchange("topic")
 	exchs["direct"] = NewDirectExchange("direct")
 	exchs[""] = NewDirectExchange("amq.direct")
 
+	decls := map[string]exchangeDecl{
+		"amq.topic":  {kind: "topic", durable: true},
+		"amq.direct": {kind: "direct", durable: true},
+		"amq.fanout": {kind: "fanout", durable: true},
+		"topic":      {kind: "topic", durable: true},
+		"direct":     {kind: "direct", durable: true},
+		"":           {kind: "direct", durable: true},
+	}
+
 	v.mu.Lock()
 	v.exchanges = exchs
+	v.exchangeDecls = decls
 	v.mu.Unlock()
 }
 
@@ -44,12 +120,6 @@ func (v *VHost) Cancel(consumer string, noWait bool) error {
 	return nil
 }
 
-// Qos isn't implemented in the fake server
-func (v *VHost) Qos(prefetchCount, prefetchSize int, global bool) error {
-	// do nothing. It's a implementation-specific tuning
-	return nil
-}
-
 func (v *VHost) ExchangeDeclare(name, kind string, opt wabbit.Option) error {
 	v.mu.Lock()
 	defer v.mu.Unlock()
@@ -66,17 +136,23 @@ func (v *VHost) ExchangeDeclarePassive(name, kind string, opt wabbit.Option) err
 
 func (v *VHost) exchangeDeclare(name, kind string, passive bool, opt wabbit.Option) error {
 	if _, ok := v.exchanges[name]; ok {
-		// TODO: We need review this. If the application is trying to re-create an exchange
-		// using other options we shall not return NIL because this indicates success,
-		// but we didn't declared anything.
-		// The AMQP 0.9.1 spec says nothing about that. It only says that AMQP uses the
-		// "declare" concept instead of the "create" concept. If something is already
-		// declared it's no problem...
-		return nil
+		if passive {
+			return nil
+		}
+
+		return v.equivalentExchange(name, kind, opt)
 	}
 
 	if passive {
-		return fmt.Errorf("exception (404) Reason: \"NOT_FOUND - no exchange '%s' in vhost '%s'\"", name, v.name)
+		return utils.NewError(utils.NotFound,
+			fmt.Sprintf("NOT_FOUND - no exchange '%s' in vhost '%s'", name, v.name),
+			true, false)
+	}
+
+	decl, err := parseExchangeDecl(kind, opt)
+
+	if err != nil {
+		return err
 	}
 
 	switch kind {
@@ -86,41 +162,164 @@ func (v *VHost) exchangeDeclare(name, kind string, passive bool, opt wabbit.Opti
 		v.exchanges[name] = NewDirectExchange(name)
 	case "headers":
 		v.exchanges[name] = NewHeadersExchange(name)
+	case "fanout":
+		v.exchanges[name] = NewFanoutExchange(name)
 	default:
-		return fmt.Errorf("invalid exchange type: %s", kind)
+		return utils.NewError(utils.CommandInvalid,
+			fmt.Sprintf("COMMAND_INVALID - unknown exchange type '%s'", kind),
+			true, false)
 	}
 
+	v.exchangeDecls[name] = decl
+
 	return nil
 }
 
+// ExchangeDelete deletes the exchange and its bindings. With the ifUnused
+// option set it fails while queues are bound to the exchange. Deleting an
+// unknown exchange is a no-op.
+func (v *VHost) ExchangeDelete(name string, opt wabbit.Option) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.exchangeDelete(name, opt)
+}
+
+func (v *VHost) exchangeDelete(name string, opt wabbit.Option) error {
+	if name == "" {
+		return utils.NewError(utils.AccessRefused,
+			"ACCESS_REFUSED - operation not permitted on the default exchange",
+			true, false)
+	}
+
+	if strings.HasPrefix(name, "amq.") {
+		return utils.NewError(utils.AccessRefused,
+			fmt.Sprintf("ACCESS_REFUSED - deletion of system exchange '%s' in vhost '%s' not allowed", name, v.name),
+			true, false)
+	}
+
+	exch, ok := v.exchanges[name]
+
+	if !ok {
+		return nil
+	}
+
+	if ifUnused, _ := opt["ifUnused"].(bool); ifUnused && exch.bound() {
+		return utils.NewError(utils.PreconditionFailed,
+			fmt.Sprintf("PRECONDITION_FAILED - exchange '%s' in vhost '%s' in use", name, v.name),
+			true, false)
+	}
+
+	delete(v.exchanges, name)
+	delete(v.exchangeDecls, name)
+
+	return nil
+}
+
+// equivalentExchange returns an error unless the redeclaration of the
+// exchange name matches its kind and flags.
+func (v *VHost) equivalentExchange(name, kind string, opt wabbit.Option) error {
+	decl, err := parseExchangeDecl(kind, opt)
+
+	if err != nil {
+		return err
+	}
+
+	current := v.exchangeDecls[name]
+
+	switch {
+	case decl.kind != current.kind:
+		return v.inequivalent("exchange", name, "type", decl.kind, current.kind)
+	case decl.durable != current.durable:
+		return v.inequivalent("exchange", name, "durable", decl.durable, current.durable)
+	case decl.autoDelete != current.autoDelete:
+		return v.inequivalent("exchange", name, "auto_delete", decl.autoDelete, current.autoDelete)
+	case decl.internal != current.internal:
+		return v.inequivalent("exchange", name, "internal", decl.internal, current.internal)
+	}
+
+	return v.inequivalentArgs("exchange", name, exchangeEquivalenceArgs, decl.args, current.args)
+}
+
+// QueueDeclare declares the queue. The vhost methods act on behalf of no
+// connection, see Channel.QueueDeclare for exclusive queues.
 func (v *VHost) QueueDeclare(name string, args wabbit.Option) (wabbit.Queue, error) {
 	v.mu.Lock()
 	defer v.mu.Unlock()
 
-	return v.queueDeclare(name, false, args)
+	return v.queueDeclare(name, false, args, "")
 }
 
 func (v *VHost) QueueDeclarePassive(name string, args wabbit.Option) (wabbit.Queue, error) {
 	v.mu.Lock()
 	defer v.mu.Unlock()
 
-	return v.queueDeclare(name, true, args)
+	return v.queueDeclare(name, true, args, "")
 }
 
-func (v *VHost) queueDeclare(name string, passive bool, args wabbit.Option) (wabbit.Queue, error) {
+// queueDeclare declares the queue on behalf of the connection connID,
+// which owns the queue when it's exclusive. An empty name declares a
+// queue named by the server, the amq. prefix is reserved for it.
+func (v *VHost) queueDeclare(name string, passive bool, args wabbit.Option, connID string) (wabbit.Queue, error) {
+	if !passive && strings.HasPrefix(name, "amq.") {
+		return nil, utils.NewError(utils.AccessRefused,
+			fmt.Sprintf("ACCESS_REFUSED - queue name '%s' contains reserved prefix 'amq.*'", name),
+			true, false)
+	}
+
+	if !passive && name == "" {
+		name = v.generateQueueName()
+	}
+
 	if q, ok := v.queues[name]; ok {
+		if err := v.locked(q, connID); err != nil {
+			return nil, err
+		}
+
+		if !passive {
+			if err := v.equivalentQueue(q, args); err != nil {
+				return nil, err
+			}
+		}
+
+		q.mu.Lock()
+		q.touch()
+		q.mu.Unlock()
+
 		return q, nil
 	}
 
 	if passive {
-		return nil, fmt.Errorf("exception (404) Reason: \"NOT_FOUND - no queue '%s' in vhost '%s'\"", name, v.name)
+		return nil, utils.NewError(utils.NotFound,
+			fmt.Sprintf("NOT_FOUND - no queue '%s' in vhost '%s'", name, v.name),
+			true, false)
+	}
+
+	flags, err := parseQueueFlags(args)
+
+	if err != nil {
+		return nil, err
+	}
+
+	qargs, err := bindingArgs(args)
+
+	if err != nil {
+		return nil, err
 	}
 
-	q := NewQueue(name)
+	parsed, invalid := parseQueueArgs(qargs)
+
+	if invalid != "" {
+		return nil, utils.NewError(utils.PreconditionFailed,
+			fmt.Sprintf("PRECONDITION_FAILED - invalid arg '%s' for queue '%s' in vhost '%s'", invalid, name, v.name),
+			true, false)
+	}
+
+	q := newVHostQueue(v, name, flags, parsed, connID)
 
 	v.queues[name] = q
 
-	err := v.queueBind(name, name, "", nil)
+	err = v.queueBind(name, name, "", nil, connID)
 
 	if err != nil {
 		return nil, err
@@ -129,37 +328,240 @@ func (v *VHost) queueDeclare(name string, passive bool, args wabbit.Option) (wab
 	return q, nil
 }
 
+// generateQueueName returns an unused amq.gen-* name for the queues
+// declared without a name. Must be called with v.mu held.
+func (v *VHost) generateQueueName() string {
+	for {
+		name := "amq.gen-" + base64.RawURLEncoding.EncodeToString(uuid.NewRandom())
+
+		if _, found := v.queues[name]; !found {
+			return name
+		}
+	}
+}
+
+// locked returns a RESOURCE_LOCKED error when q is exclusive to another
+// connection than connID.
+func (v *VHost) locked(q *Queue, connID string) error {
+	if !q.flags.exclusive || q.owner == connID {
+		return nil
+	}
+
+	return v.lockedError(q)
+}
+
+func (v *VHost) lockedError(q *Queue) error {
+	return utils.NewError(utils.ResourceLocked,
+		fmt.Sprintf("RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s' in vhost '%s'", q.name, v.name),
+		true, false)
+}
+
+// equivalentQueue returns an error unless the redeclaration of q with
+// the options opt matches its flags and arguments. As in RabbitMQ, an
+// exclusive queue can't be redeclared as a shared one or vice versa.
+func (v *VHost) equivalentQueue(q *Queue, opt wabbit.Option) error {
+	flags, err := parseQueueFlags(opt)
+
+	if err != nil {
+		return err
+	}
+
+	args, err := bindingArgs(opt)
+
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case flags.exclusive != q.flags.exclusive:
+		return v.lockedError(q)
+	case flags.durable != q.flags.durable:
+		return v.inequivalent("queue", q.name, "durable", flags.durable, q.flags.durable)
+	case flags.autoDelete != q.flags.autoDelete:
+		return v.inequivalent("queue", q.name, "auto_delete", flags.autoDelete, q.flags.autoDelete)
+	}
+
+	return v.inequivalentArgs("queue", q.name, equivalenceArgs, args, q.args.table)
+}
+
+// inequivalentArgs returns the PRECONDITION_FAILED error of the first
+// argument in names differing in the received and current arguments of
+// the exchange or queue name.
+func (v *VHost) inequivalentArgs(resource, name string, names []string, received, current wabbit.Option) error {
+	for _, arg := range names {
+		r, hasReceived := received[arg]
+		c, hasCurrent := current[arg]
+
+		if hasReceived != hasCurrent || (hasReceived && !argEqual(r, c)) {
+			return utils.NewError(utils.PreconditionFailed,
+				fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg '%s' for %s '%s' in vhost '%s': received %s but current is %s",
+					arg, resource, name, v.name, argValue(r, hasReceived), argValue(c, hasCurrent)),
+				true, false)
+		}
+	}
+
+	return nil
+}
+
+// inequivalent returns the PRECONDITION_FAILED error of a redeclaration
+// not matching the property arg of the exchange or queue name.
+func (v *VHost) inequivalent(resource, name, arg string, received, current interface{}) error {
+	return utils.NewError(utils.PreconditionFailed,
+		fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg '%s' for %s '%s' in vhost '%s': received '%v' but current is '%v'",
+			arg, resource, name, v.name, received, current),
+		true, false)
+}
+
+// QueueDelete deletes the queue and returns the number of messages
+// purged with it.
 func (v *VHost) QueueDelete(name string, args wabbit.Option) (int, error) {
 	v.mu.Lock()
-	delete(v.queues, name)
-	v.mu.Unlock()
+	defer v.mu.Unlock()
+
+	return v.queueDelete(name, args, "")
+}
+
+func (v *VHost) queueDelete(name string, args wabbit.Option, connID string) (int, error) {
+	q, ok := v.queues[name]
+
+	if !ok {
+		return 0, nil
+	}
+
+	if err := v.locked(q, connID); err != nil {
+		return 0, err
+	}
+
+	if ifUnused, _ := args["ifUnused"].(bool); ifUnused && q.Consumers() > 0 {
+		return 0, utils.NewError(utils.PreconditionFailed,
+			fmt.Sprintf("PRECONDITION_FAILED - queue '%s' in vhost '%s' in use", name, v.name),
+			true, false)
+	}
+
+	if ifEmpty, _ := args["ifEmpty"].(bool); ifEmpty && q.Messages() > 0 {
+		return 0, utils.NewError(utils.PreconditionFailed,
+			fmt.Sprintf("PRECONDITION_FAILED - queue '%s' in vhost '%s' is not empty", name, v.name),
+			true, false)
+	}
+
+	return v.deleteQueue(q), nil
+}
+
+// QueuePurge removes the ready messages of the queue and returns their
+// number. The messages delivered and not acked yet are kept.
+func (v *VHost) QueuePurge(name string, opt wabbit.Option) (int, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.queuePurge(name, opt, "")
+}
+
+func (v *VHost) queuePurge(name string, _ wabbit.Option, connID string) (int, error) {
+	q, ok := v.queues[name]
+
+	if !ok {
+		return 0, utils.NewError(utils.NotFound,
+			fmt.Sprintf("NOT_FOUND - no queue '%s' in vhost '%s'", name, v.name),
+			true, false)
+	}
+
+	if err := v.locked(q, connID); err != nil {
+		return 0, err
+	}
+
+	return q.purge(), nil
+}
+
+// deleteQueue removes q and its bindings from the vhost, cancels its
+// consumers and returns the number of messages purged with it. Must be
+// called with v.mu held.
+func (v *VHost) deleteQueue(q *Queue) int {
+	delete(v.queues, q.name)
+
+	for _, exch := range v.exchanges {
+		exch.unbindQueue(q)
+	}
+
+	// the messages of the stopped consumers are requeued, then purged
+	// with the queue. Their channels may be waiting for v.mu, then
+	// they forget the consumers in background.
+	for _, c := range q.unsubscribeAll() {
+		c.stop()
+		go c.channel.serverCancel(c)
+	}
+
+	return q.purge()
+}
+
+// autoDelete deletes the auto-delete queue q after its last consumer is
+// gone, unless a new consumer subscribed meanwhile.
+func (v *VHost) autoDelete(q *Queue) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.queues[q.name] != q || q.Consumers() > 0 {
+		return
+	}
+
+	v.deleteQueue(q)
+}
 
-	return 0, nil
+// deleteExclusive deletes the exclusive queues owned by the connection
+// connID, when it's closed.
+func (v *VHost) deleteExclusive(connID string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for _, q := range v.queues {
+		if q.flags.exclusive && q.owner == connID {
+			v.deleteQueue(q)
+		}
+	}
 }
 
 func (v *VHost) QueueBind(name, key, exchange string, options wabbit.Option) error {
 	v.mu.Lock()
 	defer v.mu.Unlock()
 
-	return v.queueBind(name, key, exchange, options)
+	return v.queueBind(name, key, exchange, options, "")
 }
 
-func (v *VHost) queueBind(name, key, exchange string, _ wabbit.Option) error {
+func (v *VHost) queueBind(name, key, exchange string, options wabbit.Option, connID string) error {
 	var (
 		exch Exchange
 		q    *Queue
 		ok   bool
 	)
 
+	args, err := bindingArgs(options)
+
+	if err != nil {
+		return err
+	}
+
 	if exch, ok = v.exchanges[exchange]; !ok {
-		return fmt.Errorf("unknown exchange '%s'", exchange)
+		return utils.NewError(utils.NotFound,
+			fmt.Sprintf("NOT_FOUND - no exchange '%s' in vhost '%s'", exchange, v.name),
+			true, false)
 	}
 
 	if q, ok = v.queues[name]; !ok {
-		return fmt.Errorf("unknown queue '%s'", name)
+		return utils.NewError(utils.NotFound,
+			fmt.Sprintf("NOT_FOUND - no queue '%s' in vhost '%s'", name, v.name),
+			true, false)
+	}
+
+	if err = v.locked(q, connID); err != nil {
+		return err
+	}
+
+	if _, ok = exch.(*HeadersExchange); ok {
+		if _, _, err = headersMatchMode(args); err != nil {
+			return err
+		}
 	}
 
-	exch.addBinding(key, &BindingsMap{q, nil})
+	exch.addBinding(key, &BindingsMap{q, args})
 	return nil
 }
 
@@ -167,53 +569,112 @@ func (v *VHost) QueueUnbind(name, key, exchange string, options wabbit.Option) e
 	v.mu.Lock()
 	defer v.mu.Unlock()
 
-	return v.queueUnbind(name, key, exchange, options)
+	return v.queueUnbind(name, key, exchange, options, "")
 }
 
-func (v *VHost) queueUnbind(name, key, exchange string, _ wabbit.Option) error {
+func (v *VHost) queueUnbind(name, key, exchange string, options wabbit.Option, connID string) error {
 	var (
 		exch Exchange
+		q    *Queue
 		ok   bool
 	)
 
+	args, err := bindingArgs(options)
+
+	if err != nil {
+		return err
+	}
+
 	if exch, ok = v.exchanges[exchange]; !ok {
-		return fmt.Errorf("unknown exchange '%s'", exchange)
+		return utils.NewError(utils.NotFound,
+			fmt.Sprintf("NOT_FOUND - no exchange '%s' in vhost '%s'", exchange, v.name),
+			true, false)
 	}
 
-	if _, ok = v.queues[name]; !ok {
-		return fmt.Errorf("unknown queue '%s'", name)
+	if q, ok = v.queues[name]; !ok {
+		return utils.NewError(utils.NotFound,
+			fmt.Sprintf("NOT_FOUND - no queue '%s' in vhost '%s'", name, v.name),
+			true, false)
+	}
+
+	if err = v.locked(q, connID); err != nil {
+		return err
 	}
 
-	exch.delBinding(key)
+	exch.delBinding(key, &BindingsMap{q, args})
 	return nil
 }
 
-// Publish push a new message to queue data channel.
-// The queue data channel is a buffered channel of length `QueueMaxLen`. If
-// the queue is full, this method will block until some messages are consumed.
+// Publish push a new message to the queues bound to the exchange.
 func (v *VHost) Publish(exc, route string, d *Delivery, options wabbit.Option) error {
 	v.mu.Lock()
 	defer v.mu.Unlock()
 
-	return v.publish(exc, route, d, options)
+	_, err := v.publish(exc, route, d, options)
+	return err
 }
 
-func (v *VHost) publish(exc, route string, d *Delivery, _ wabbit.Option) error {
-	var (
-		exch Exchange
-		ok   bool
-		err  error
-	)
+// publish routes d through the exchange
+func (v *VHost) publish(exc, route string, d *Delivery, _ wabbit.Option) (routing, error) {
+	exch, ok := v.exchanges[exc]
 
-	if exch, ok = v.exchanges[exc]; !ok {
-		return fmt.Errorf("unknow exchange '%s'", exc)
+	if !ok {
+		return routing{}, utils.NewError(utils.NotFound,
+			fmt.Sprintf("NOT_FOUND - no exchange '%s' in vhost '%s'", exc, v.name),
+			true, false)
 	}
 
-	err = exch.route(route, d)
+	r, err := exch.route(route, d)
 
-	if err != nil {
-		return err
+	v.deadLetterAll(r.overflowed)
+
+	return r, err
+}
+
+// SetClock replaces the clock of the message TTLs and queue expiry, eg.:
+// by a ManualClock in tests. Set it before declaring the queues, the
+// expiry timers already armed keep running on the former clock.
+func (v *VHost) SetClock(c Clock) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.clock = c
+
+	for _, q := range v.queues {
+		q.mu.Lock()
+		q.clock = c
+		q.timerAt = time.Time{}
+		q.mu.Unlock()
 	}
+}
 
-	return nil
+// expire dead-letters the expired messages of q, or deletes q when it's
+// unused for longer than its x-expires. It runs on the expiry timers.
+func (v *VHost) expire(q *Queue) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.queues[q.name] != q {
+		// deleted meanwhile
+		return
+	}
+
+	now := v.clock.Now()
+
+	if q.unused(now) {
+		v.deleteQueue(q)
+		return
+	}
+
+	v.deadLetter(q, q.expired(now), deathExpired)
+}
+
+// NackPublishes makes the channels in confirm mode nack the publishes
+// for which fn returns true, instead of routing them. It's a test hook
+// for the publisher retry paths. A nil fn disables it.
+func (v *VHost) NackPublishes(fn func(exchange, key string, body []byte) bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.nackHook = fn
 }
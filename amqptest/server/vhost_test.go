@@ -1,9 +1,12 @@
 package server
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/NeowayLabs/wabbit"
+	"github.com/NeowayLabs/wabbit/utils"
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 func TestVHostWithDefaults(t *testing.T) {
@@ -53,6 +56,57 @@ func TestQueueDeclare(t *testing.T) {
 	}
 }
 
+func TestServerNamedQueue(t *testing.T) {
+	vh := NewVHost("/")
+
+	q1, err := vh.QueueDeclare("", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	q2, err := vh.QueueDeclare("", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !strings.HasPrefix(q1.Name(), "amq.gen-") || q1.Name() == q2.Name() {
+		t.Errorf("Invalid server-named queues: '%s' '%s'", q1.Name(), q2.Name())
+		return
+	}
+
+	if _, ok := vh.queues[""]; ok {
+		t.Error("Queue declared with an empty name")
+		return
+	}
+
+	if err = NewChannel(vh).Publish("", q1.Name(), []byte("teste"), nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if q1.Messages() != 1 || q2.Messages() != 0 {
+		t.Errorf("Server-named queue not bound to the default exchange: %d %d", q1.Messages(), q2.Messages())
+		return
+	}
+
+	if _, err = vh.QueueDeclarePassive(q1.Name(), nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, name := range []string{q1.Name(), "amq.custom"} {
+		_, err = vh.QueueDeclare(name, nil)
+
+		if e, ok := err.(wabbit.Error); !ok || e.Code() != utils.AccessRefused {
+			t.Errorf("Declaring %s shall fail with ACCESS_REFUSED: %v", name, err)
+		}
+	}
+}
+
 func TestBasicExchangeDeclare(t *testing.T) {
 	vh := NewVHost("/")
 
@@ -70,7 +124,7 @@ func TestBasicExchangeDeclare(t *testing.T) {
 		return
 	}
 
-	if len(vh.exchanges) != 6 {
+	if len(vh.exchanges) != 7 {
 		t.Errorf("Exchange not properly created: %d", len(vh.exchanges))
 		return
 	}
@@ -117,7 +171,7 @@ func TestQueueBind(t *testing.T) {
 		return
 	}
 
-	err = nwExchange.route("process.data", NewDelivery(&Channel{}, []byte{}, 1, "", wabbit.Option{}, ""))
+	_, err = nwExchange.route("process.data", NewDelivery(&Channel{}, []byte{}, 1, "", wabbit.Option{}, ""))
 
 	if err != nil {
 		t.Error(err)
@@ -168,10 +222,440 @@ func TestBasicPublish(t *testing.T) {
 		return
 	}
 
-	data := <-serverQueue.data
+	data, _ := serverQueue.pop()
 
-	if string(data.Body()) != "teste" {
+	if data == nil || string(data.Body()) != "teste" {
 		t.Errorf("Failed to publish message to specified route")
 		return
 	}
 }
+
+func TestFanoutExchange(t *testing.T) {
+	vh := NewVHost("/")
+
+	if _, ok := vh.exchanges["amq.fanout"].(*FanoutExchange); !ok {
+		t.Errorf("amq.fanout exchange not declared by default")
+	}
+
+	err := vh.ExchangeDeclare("neoway", "fanout", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	queues := make([]*Queue, 0, 2)
+
+	for _, name := range []string{"fanout-a", "fanout-b"} {
+		q, err := vh.QueueDeclare(name, nil)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = vh.QueueBind(name, "ignored."+name, "neoway", nil)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		queues = append(queues, q.(*Queue))
+	}
+
+	err = vh.Publish("neoway", "any.route", NewDelivery(&Channel{}, []byte("teste"), 1, "", wabbit.Option{}, ""), nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, q := range queues {
+		if q.Messages() != 1 {
+			t.Errorf("Queue %s received %d messages", q.name, q.Messages())
+			return
+		}
+
+		q.pop()
+	}
+
+	err = vh.QueueUnbind("fanout-a", "ignored.fanout-a", "neoway", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = vh.Publish("neoway", "", NewDelivery(&Channel{}, []byte("teste"), 2, "", wabbit.Option{}, ""), nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if queues[0].Messages() != 0 || queues[1].Messages() != 1 {
+		t.Errorf("Unbound queue received message: %d %d", queues[0].Messages(), queues[1].Messages())
+	}
+}
+
+func TestTopicExchangeRoutesToEveryMatchingQueue(t *testing.T) {
+	vh := NewVHost("/")
+
+	err := vh.ExchangeDeclare("orders", "topic", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	bindings := []struct {
+		queue, key string
+	}{
+		{"orders-star", "orders.*"},
+		{"orders-hash", "orders.#"},
+		{"orders-all", "#"},
+		{"orders-all", "orders.created"},
+		{"payments", "payments.*"},
+	}
+
+	for _, b := range bindings {
+		if _, err = vh.QueueDeclare(b.queue, nil); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if err = vh.QueueBind(b.queue, b.key, "orders", nil); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	err = vh.Publish("orders", "orders.created", NewDelivery(&Channel{}, []byte("teste"), 1, "", wabbit.Option{}, ""), nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for name, expected := range map[string]int{
+		"orders-star": 1,
+		"orders-hash": 1,
+		"orders-all":  1,
+		"payments":    0,
+	} {
+		if got := vh.queues[name].Messages(); got != expected {
+			t.Errorf("Queue %s received %d messages, expected %d", name, got, expected)
+		}
+	}
+
+	err = vh.Publish("orders", "orders.created.eu", NewDelivery(&Channel{}, []byte("teste"), 2, "", wabbit.Option{}, ""), nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if vh.queues["orders-star"].Messages() != 1 || vh.queues["orders-hash"].Messages() != 2 {
+		t.Errorf("'*' shall match exactly one word and '#' many words")
+	}
+}
+
+func TestDirectExchangeSharedRoutingKey(t *testing.T) {
+	vh := NewVHost("/")
+
+	err := vh.ExchangeDeclare("neoway", "direct", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, name := range []string{"shared-a", "shared-b"} {
+		if _, err = vh.QueueDeclare(name, nil); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if err = vh.QueueBind(name, "process.data", "neoway", nil); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	// binding again with the same key and arguments is a no-op
+	if err = vh.QueueBind("shared-a", "process.data", "neoway", nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = vh.Publish("neoway", "process.data", NewDelivery(&Channel{}, []byte("teste"), 1, "", wabbit.Option{}, ""), nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if vh.queues["shared-a"].Messages() != 1 || vh.queues["shared-b"].Messages() != 1 {
+		t.Errorf("Every queue bound with the routing key shall receive one copy")
+		return
+	}
+
+	err = vh.QueueUnbind("shared-a", "process.data", "neoway", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = vh.Publish("neoway", "process.data", NewDelivery(&Channel{}, []byte("teste"), 2, "", wabbit.Option{}, ""), nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if vh.queues["shared-a"].Messages() != 1 || vh.queues["shared-b"].Messages() != 2 {
+		t.Errorf("Unbind shall remove only the binding of the named queue")
+	}
+}
+
+func TestHeadersExchangeBindingArgs(t *testing.T) {
+	vh := NewVHost("/")
+
+	err := vh.ExchangeDeclare("neoway", "headers", nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for name, args := range map[string]amqp.Table{
+		"headers-pdf": {"x-match": "all", "format": "pdf", "pages": int32(2)},
+		"headers-any": {"x-match": "any", "format": "zip", "pages": int32(2)},
+	} {
+		if _, err = vh.QueueDeclare(name, nil); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if err = vh.QueueBind(name, "", "neoway", wabbit.Option{"args": args}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	err = vh.Publish("neoway", "", NewDelivery(&Channel{}, []byte("teste"), 1, "", wabbit.Option{"format": "pdf", "pages": int64(2)}, ""), nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = vh.Publish("neoway", "", NewDelivery(&Channel{}, []byte("teste"), 2, "", wabbit.Option{"format": "zip", "pages": "2"}, ""), nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if vh.queues["headers-pdf"].Messages() != 1 || vh.queues["headers-any"].Messages() != 2 {
+		t.Errorf("Messages routed ignoring the binding arguments: %d %d",
+			vh.queues["headers-pdf"].Messages(), vh.queues["headers-any"].Messages())
+		return
+	}
+
+	err = vh.QueueBind("headers-pdf", "", "neoway", wabbit.Option{"args": "invalid"})
+
+	if err == nil {
+		t.Errorf("QueueBind shall fail with args of invalid type")
+		return
+	}
+
+	err = vh.QueueBind("headers-any", "", "neoway", wabbit.Option{"args": amqp.Table{"x-match": "bogus"}})
+
+	if e, ok := err.(wabbit.Error); !ok || e.Code() != utils.PreconditionFailed {
+		t.Errorf("QueueBind with an invalid x-match shall fail with PRECONDITION_FAILED: %v", err)
+		return
+	}
+
+	// the valid bindings keep routing
+	err = vh.Publish("neoway", "", NewDelivery(&Channel{}, []byte("teste"), 3, "", wabbit.Option{"format": "pdf", "pages": int32(2)}, ""), nil)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if vh.queues["headers-pdf"].Messages() != 2 {
+		t.Errorf("Message not routed after the invalid binding: %d", vh.queues["headers-pdf"].Messages())
+	}
+}
+
+func TestInequivalentRedeclare(t *testing.T) {
+	vh := NewVHost("/")
+
+	err := vh.ExchangeDeclare("neoway", "direct", wabbit.Option{"durable": true})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = vh.QueueDeclare("data", wabbit.Option{
+		"durable": true,
+		"args":    amqp.Table{"x-message-ttl": int32(1000)},
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// equivalent redeclarations
+	if err = vh.ExchangeDeclare("neoway", "direct", wabbit.Option{"durable": true}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = vh.ExchangeDeclarePassive("neoway", "topic", nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = vh.QueueDeclare("data", wabbit.Option{
+		"durable": true,
+		"args":    amqp.Table{"x-message-ttl": int64(1000)},
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err = vh.QueueDeclarePassive("data", nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	inequivalent := func(what string, err error) {
+		if e, ok := err.(wabbit.Error); !ok || e.Code() != utils.PreconditionFailed {
+			t.Errorf("Redeclaring %s shall fail with PRECONDITION_FAILED: %v", what, err)
+		}
+	}
+
+	err = vh.ExchangeDeclare("neoway", "fanout", wabbit.Option{"durable": true})
+	inequivalent("the exchange type", err)
+
+	err = vh.ExchangeDeclare("neoway", "direct", nil)
+	inequivalent("the exchange durability", err)
+
+	err = vh.ExchangeDeclare("alternate", "fanout", wabbit.Option{
+		"args": amqp.Table{"alternate-exchange": "neoway"},
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = vh.ExchangeDeclare("alternate", "fanout", wabbit.Option{
+		"args": amqp.Table{"alternate-exchange": "neoway"},
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// only alternate-exchange is compared
+	err = vh.ExchangeDeclare("alternate", "fanout", wabbit.Option{
+		"args": amqp.Table{"alternate-exchange": "neoway", "x-custom": "value"},
+	})
+
+	if err != nil {
+		t.Errorf("Redeclaration with an unrelated argument shall succeed: %v", err)
+		return
+	}
+
+	err = vh.ExchangeDeclare("alternate", "fanout", nil)
+	inequivalent("the exchange without arguments", err)
+
+	_, err = vh.QueueDeclare("data", wabbit.Option{
+		"args": amqp.Table{"x-message-ttl": int32(1000)},
+	})
+	inequivalent("the queue durability", err)
+
+	_, err = vh.QueueDeclare("data", wabbit.Option{
+		"durable": true,
+		"args":    amqp.Table{"x-message-ttl": int32(2000)},
+	})
+	inequivalent("the queue TTL", err)
+
+	_, err = vh.QueueDeclare("data", wabbit.Option{"durable": true})
+	inequivalent("the queue without TTL", err)
+
+	_, err = vh.QueueDeclare("data", wabbit.Option{
+		"durable": true,
+		"args": amqp.Table{
+			"x-message-ttl": int32(1000),
+			"x-max-length":  int32(10),
+		},
+	})
+	inequivalent("the queue with a length limit", err)
+}
+
+func TestExchangeDelete(t *testing.T) {
+	vh := NewVHost("/")
+
+	for _, name := range []string{"", "amq.direct"} {
+		err := vh.ExchangeDelete(name, nil)
+
+		if e, ok := err.(wabbit.Error); !ok || e.Code() != utils.AccessRefused {
+			t.Errorf("Deleting the exchange '%s' shall fail with ACCESS_REFUSED: %v", name, err)
+			return
+		}
+	}
+
+	if err := vh.ExchangeDeclare("neoway", "topic", nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := vh.QueueDeclare("data", nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := vh.QueueBind("data", "data.#", "neoway", nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	err := vh.ExchangeDelete("neoway", wabbit.Option{"ifUnused": true})
+
+	if e, ok := err.(wabbit.Error); !ok || e.Code() != utils.PreconditionFailed {
+		t.Errorf("Deleting an exchange in use shall fail with PRECONDITION_FAILED: %v", err)
+		return
+	}
+
+	if err = vh.QueueUnbind("data", "data.#", "neoway", nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = vh.ExchangeDelete("neoway", wabbit.Option{"ifUnused": true}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = vh.ExchangeDeclarePassive("neoway", "topic", nil); err == nil {
+		t.Errorf("Exchange not deleted")
+		return
+	}
+
+	// redeclared with another type
+	if err = vh.ExchangeDeclare("neoway", "fanout", nil); err != nil {
+		t.Error(err)
+	}
+}
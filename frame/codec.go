@@ -0,0 +1,548 @@
+package frame
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Properties are the message properties of a content header
+type Properties struct {
+	ContentType     string
+	ContentEncoding string
+	Headers         amqp.Table
+	DeliveryMode    uint8
+	Priority        uint8
+	CorrelationId   string
+	ReplyTo         string
+	Expiration      string
+	MessageId       string
+	Timestamp       time.Time
+	Type            string
+	UserId          string
+	AppId           string
+}
+
+// Decoder decodes method arguments and content header properties. The
+// first error is kept and every read after it returns zero values.
+type Decoder struct {
+	buf  *bytes.Reader
+	bits byte
+	nbit uint
+	err  error
+}
+
+// NewDecoder returns a decoder of payload
+func NewDecoder(payload []byte) *Decoder {
+	return &Decoder{buf: bytes.NewReader(payload)}
+}
+
+// Err returns the first error found while decoding
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Len returns the number of bytes not decoded yet
+func (d *Decoder) Len() int {
+	return d.buf.Len()
+}
+
+func (d *Decoder) read(v interface{}) {
+	d.nbit = 0
+
+	if d.err != nil {
+		return
+	}
+
+	d.err = binary.Read(d.buf, binary.BigEndian, v)
+}
+
+// Octet decodes an octet
+func (d *Decoder) Octet() uint8 {
+	var v uint8
+	d.read(&v)
+	return v
+}
+
+// Short decodes a 16 bits integer
+func (d *Decoder) Short() uint16 {
+	var v uint16
+	d.read(&v)
+	return v
+}
+
+// Long decodes a 32 bits integer
+func (d *Decoder) Long() uint32 {
+	var v uint32
+	d.read(&v)
+	return v
+}
+
+// LongLong decodes a 64 bits integer
+func (d *Decoder) LongLong() uint64 {
+	var v uint64
+	d.read(&v)
+	return v
+}
+
+// Bit decodes the next packed bit. Consecutive bits share the same octet.
+func (d *Decoder) Bit() bool {
+	if d.nbit == 0 || d.nbit == 8 {
+		var b uint8
+		d.read(&b)
+		d.bits = b
+	}
+
+	v := d.bits&(1<<d.nbit) != 0
+	d.nbit++
+	return v
+}
+
+// ShortStr decodes a short string
+func (d *Decoder) ShortStr() string {
+	n := d.Octet()
+	return string(d.bytes(int(n)))
+}
+
+// LongStr decodes a long string
+func (d *Decoder) LongStr() string {
+	n := d.Long()
+	return string(d.bytes(int(n)))
+}
+
+func (d *Decoder) bytes(n int) []byte {
+	d.nbit = 0
+
+	if d.err != nil {
+		return nil
+	}
+
+	if n > d.buf.Len() {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	b := make([]byte, n)
+	_, d.err = io.ReadFull(d.buf, b)
+	return b
+}
+
+// Timestamp decodes a timestamp with seconds precision
+func (d *Decoder) Timestamp() time.Time {
+	return time.Unix(int64(d.LongLong()), 0)
+}
+
+// Table decodes a field table
+func (d *Decoder) Table() amqp.Table {
+	nested := NewDecoder(d.bytes(int(d.Long())))
+
+	if d.err != nil {
+		return nil
+	}
+
+	table := amqp.Table{}
+
+	for nested.Len() > 0 {
+		key := nested.ShortStr()
+		value := nested.Field()
+
+		if nested.err != nil {
+			d.err = nested.err
+			return nil
+		}
+
+		table[key] = value
+	}
+
+	return table
+}
+
+// Field decodes a typed field value of a field table or array. Values
+// have the same Go types used by rabbitmq/amqp091-go.
+func (d *Decoder) Field() interface{} {
+	typ := d.Octet()
+
+	switch typ {
+	case 't':
+		return d.Octet() != 0
+	case 'B':
+		return d.Octet()
+	case 'b':
+		return int8(d.Octet())
+	case 's':
+		return int16(d.Short())
+	case 'I':
+		return int32(d.Long())
+	case 'l':
+		return int64(d.LongLong())
+	case 'f':
+		return math.Float32frombits(d.Long())
+	case 'd':
+		return math.Float64frombits(d.LongLong())
+	case 'D':
+		return amqp.Decimal{Scale: d.Octet(), Value: int32(d.Long())}
+	case 'S':
+		return d.LongStr()
+	case 'A':
+		nested := NewDecoder(d.bytes(int(d.Long())))
+		arr := []interface{}{}
+
+		for d.err == nil && nested.Len() > 0 {
+			v := nested.Field()
+
+			if nested.err != nil {
+				d.err = nested.err
+				return nil
+			}
+
+			arr = append(arr, v)
+		}
+
+		return arr
+	case 'T':
+		return d.Timestamp()
+	case 'F':
+		return d.Table()
+	case 'x':
+		return d.bytes(int(d.Long()))
+	case 'V':
+		return nil
+	}
+
+	if d.err == nil {
+		d.err = ErrFieldType
+	}
+
+	return nil
+}
+
+// Properties decodes the property flags and the property list of a
+// content header.
+func (d *Decoder) Properties() Properties {
+	var p Properties
+
+	flags := d.Short()
+
+	if flags&FlagContentType != 0 {
+		p.ContentType = d.ShortStr()
+	}
+	if flags&FlagContentEncoding != 0 {
+		p.ContentEncoding = d.ShortStr()
+	}
+	if flags&FlagHeaders != 0 {
+		p.Headers = d.Table()
+	}
+	if flags&FlagDeliveryMode != 0 {
+		p.DeliveryMode = d.Octet()
+	}
+	if flags&FlagPriority != 0 {
+		p.Priority = d.Octet()
+	}
+	if flags&FlagCorrelationId != 0 {
+		p.CorrelationId = d.ShortStr()
+	}
+	if flags&FlagReplyTo != 0 {
+		p.ReplyTo = d.ShortStr()
+	}
+	if flags&FlagExpiration != 0 {
+		p.Expiration = d.ShortStr()
+	}
+	if flags&FlagMessageId != 0 {
+		p.MessageId = d.ShortStr()
+	}
+	if flags&FlagTimestamp != 0 {
+		p.Timestamp = d.Timestamp()
+	}
+	if flags&FlagType != 0 {
+		p.Type = d.ShortStr()
+	}
+	if flags&FlagUserId != 0 {
+		p.UserId = d.ShortStr()
+	}
+	if flags&FlagAppId != 0 {
+		p.AppId = d.ShortStr()
+	}
+
+	return p
+}
+
+// Encoder encodes method arguments and content header properties. The
+// first error is kept and returned by Bytes.
+type Encoder struct {
+	buf  bytes.Buffer
+	bits byte
+	nbit uint
+	err  error
+}
+
+// NewEncoder returns an empty encoder
+func NewEncoder() *Encoder {
+	return &Encoder{}
+}
+
+// Bytes returns the encoded payload or the first encoding error
+func (e *Encoder) Bytes() ([]byte, error) {
+	e.flush()
+	return e.buf.Bytes(), e.err
+}
+
+// flush writes the pending packed bits, if any.
+func (e *Encoder) flush() {
+	if e.nbit > 0 {
+		e.buf.WriteByte(e.bits)
+		e.bits = 0
+		e.nbit = 0
+	}
+}
+
+func (e *Encoder) setErr(err error) {
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+// Octet encodes an octet
+func (e *Encoder) Octet(v uint8) {
+	e.flush()
+	e.buf.WriteByte(v)
+}
+
+// Short encodes a 16 bits integer
+func (e *Encoder) Short(v uint16) {
+	e.flush()
+	binary.Write(&e.buf, binary.BigEndian, v)
+}
+
+// Long encodes a 32 bits integer
+func (e *Encoder) Long(v uint32) {
+	e.flush()
+	binary.Write(&e.buf, binary.BigEndian, v)
+}
+
+// LongLong encodes a 64 bits integer
+func (e *Encoder) LongLong(v uint64) {
+	e.flush()
+	binary.Write(&e.buf, binary.BigEndian, v)
+}
+
+// Bit encodes a bit. Consecutive bits are packed in the same octet.
+func (e *Encoder) Bit(v bool) {
+	if e.nbit == 8 {
+		e.flush()
+	}
+
+	if v {
+		e.bits |= 1 << e.nbit
+	}
+
+	e.nbit++
+}
+
+// ShortStr encodes a short string of at most 255 bytes
+func (e *Encoder) ShortStr(s string) {
+	if len(s) > math.MaxUint8 {
+		e.setErr(fmt.Errorf("frame: short string too long: %d bytes", len(s)))
+		return
+	}
+
+	e.Octet(uint8(len(s)))
+	e.buf.WriteString(s)
+}
+
+// LongStr encodes a long string
+func (e *Encoder) LongStr(s string) {
+	e.Long(uint32(len(s)))
+	e.buf.WriteString(s)
+}
+
+// Timestamp encodes a timestamp with seconds precision
+func (e *Encoder) Timestamp(t time.Time) {
+	e.LongLong(uint64(t.Unix()))
+}
+
+// Table encodes a field table
+func (e *Encoder) Table(t amqp.Table) {
+	nested := NewEncoder()
+
+	for key, value := range t {
+		nested.ShortStr(key)
+		nested.Field(value)
+	}
+
+	payload, err := nested.Bytes()
+
+	if err != nil {
+		e.setErr(err)
+	}
+
+	e.LongStr(string(payload))
+}
+
+// Field encodes a typed field value of a field table or array. The
+// supported Go types are the same of rabbitmq/amqp091-go.
+func (e *Encoder) Field(value interface{}) {
+	switch v := value.(type) {
+	case bool:
+		e.Octet('t')
+		if v {
+			e.Octet(1)
+		} else {
+			e.Octet(0)
+		}
+	case byte:
+		e.Octet('B')
+		e.Octet(v)
+	case int8:
+		e.Octet('b')
+		e.Octet(uint8(v))
+	case int16:
+		e.Octet('s')
+		e.Short(uint16(v))
+	case int:
+		e.Octet('I')
+		e.Long(uint32(v))
+	case int32:
+		e.Octet('I')
+		e.Long(uint32(v))
+	case int64:
+		e.Octet('l')
+		e.LongLong(uint64(v))
+	case float32:
+		e.Octet('f')
+		e.Long(math.Float32bits(v))
+	case float64:
+		e.Octet('d')
+		e.LongLong(math.Float64bits(v))
+	case amqp.Decimal:
+		e.Octet('D')
+		e.Octet(v.Scale)
+		e.Long(uint32(v.Value))
+	case string:
+		e.Octet('S')
+		e.LongStr(v)
+	case []interface{}:
+		nested := NewEncoder()
+
+		for _, item := range v {
+			nested.Field(item)
+		}
+
+		payload, err := nested.Bytes()
+
+		if err != nil {
+			e.setErr(err)
+		}
+
+		e.Octet('A')
+		e.LongStr(string(payload))
+	case time.Time:
+		e.Octet('T')
+		e.Timestamp(v)
+	case amqp.Table:
+		e.Octet('F')
+		e.Table(v)
+	case map[string]interface{}:
+		e.Octet('F')
+		e.Table(amqp.Table(v))
+	case []byte:
+		e.Octet('x')
+		e.LongStr(string(v))
+	case nil:
+		e.Octet('V')
+	default:
+		e.setErr(ErrFieldType)
+	}
+}
+
+// Properties encodes the property flags and the property list of a
+// content header. Only the properties with non-zero values are encoded.
+func (e *Encoder) Properties(p Properties) {
+	var flags uint16
+
+	if p.ContentType != "" {
+		flags |= FlagContentType
+	}
+	if p.ContentEncoding != "" {
+		flags |= FlagContentEncoding
+	}
+	if len(p.Headers) > 0 {
+		flags |= FlagHeaders
+	}
+	if p.DeliveryMode > 0 {
+		flags |= FlagDeliveryMode
+	}
+	if p.Priority > 0 {
+		flags |= FlagPriority
+	}
+	if p.CorrelationId != "" {
+		flags |= FlagCorrelationId
+	}
+	if p.ReplyTo != "" {
+		flags |= FlagReplyTo
+	}
+	if p.Expiration != "" {
+		flags |= FlagExpiration
+	}
+	if p.MessageId != "" {
+		flags |= FlagMessageId
+	}
+	if !p.Timestamp.IsZero() {
+		flags |= FlagTimestamp
+	}
+	if p.Type != "" {
+		flags |= FlagType
+	}
+	if p.UserId != "" {
+		flags |= FlagUserId
+	}
+	if p.AppId != "" {
+		flags |= FlagAppId
+	}
+
+	e.Short(flags)
+
+	if flags&FlagContentType != 0 {
+		e.ShortStr(p.ContentType)
+	}
+	if flags&FlagContentEncoding != 0 {
+		e.ShortStr(p.ContentEncoding)
+	}
+	if flags&FlagHeaders != 0 {
+		e.Table(p.Headers)
+	}
+	if flags&FlagDeliveryMode != 0 {
+		e.Octet(p.DeliveryMode)
+	}
+	if flags&FlagPriority != 0 {
+		e.Octet(p.Priority)
+	}
+	if flags&FlagCorrelationId != 0 {
+		e.ShortStr(p.CorrelationId)
+	}
+	if flags&FlagReplyTo != 0 {
+		e.ShortStr(p.ReplyTo)
+	}
+	if flags&FlagExpiration != 0 {
+		e.ShortStr(p.Expiration)
+	}
+	if flags&FlagMessageId != 0 {
+		e.ShortStr(p.MessageId)
+	}
+	if flags&FlagTimestamp != 0 {
+		e.Timestamp(p.Timestamp)
+	}
+	if flags&FlagType != 0 {
+		e.ShortStr(p.Type)
+	}
+	if flags&FlagUserId != 0 {
+		e.ShortStr(p.UserId)
+	}
+	if flags&FlagAppId != 0 {
+		e.ShortStr(p.AppId)
+	}
+}
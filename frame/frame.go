@@ -0,0 +1,247 @@
+// Package frame implements a reader and a writer of AMQP 0-9-1 frames.
+// It encodes and decodes method frames, content headers, body frames,
+// heartbeats and field tables compatible with rabbitmq/amqp091-go, and is
+// useful to write proxies, sniffers and fake brokers.
+package frame
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/NeowayLabs/wabbit/utils"
+)
+
+var (
+	// ProtocolHeader is sent by clients before the first frame
+	ProtocolHeader = []byte{'A', 'M', 'Q', 'P', 0, 0, 9, 1}
+
+	// ErrFrame is returned when a frame is malformed
+	ErrFrame = errors.New("frame: malformed frame")
+
+	// ErrFieldType is returned when a field table value has an
+	// unsupported type
+	ErrFieldType = errors.New("frame: unsupported field type")
+)
+
+// Frame is a raw AMQP frame
+type Frame struct {
+	Type    uint8
+	Channel uint16
+	Payload []byte
+}
+
+// Reader reads frames from an input stream
+type Reader struct {
+	r *bufio.Reader
+
+	// MaxSize limits the payload size of frames. Zero means no limit.
+	MaxSize uint32
+}
+
+// NewReader returns a frame reader of r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// ReadProtocolHeader reads the protocol header sent by clients when
+// opening the connection.
+func (r *Reader) ReadProtocolHeader() ([]byte, error) {
+	header := make([]byte, len(ProtocolHeader))
+
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		return nil, err
+	}
+
+	return header, nil
+}
+
+// ReadFrame reads the next frame
+func (r *Reader) ReadFrame() (*Frame, error) {
+	var hdr [7]byte
+
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(hdr[3:7])
+
+	if r.MaxSize > 0 && size > r.MaxSize {
+		return nil, fmt.Errorf("frame: payload of %d bytes exceeds %d", size, r.MaxSize)
+	}
+
+	f := &Frame{
+		Type:    hdr[0],
+		Channel: binary.BigEndian.Uint16(hdr[1:3]),
+		Payload: make([]byte, size),
+	}
+
+	switch f.Type {
+	case utils.FrameMethod, utils.FrameHeader, utils.FrameBody, utils.FrameHeartbeat:
+	default:
+		return nil, ErrFrame
+	}
+
+	if _, err := io.ReadFull(r.r, f.Payload); err != nil {
+		return nil, err
+	}
+
+	end, err := r.r.ReadByte()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if end != utils.FrameEnd || (f.Type == utils.FrameHeartbeat && size > 0) {
+		return nil, ErrFrame
+	}
+
+	return f, nil
+}
+
+// Writer writes frames to an output stream. Frames are buffered until
+// Flush is called.
+type Writer struct {
+	w *bufio.Writer
+}
+
+// NewWriter returns a frame writer of w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// WriteFrame writes f to the buffer
+func (w *Writer) WriteFrame(f *Frame) error {
+	var hdr [7]byte
+
+	hdr[0] = f.Type
+	binary.BigEndian.PutUint16(hdr[1:3], f.Channel)
+	binary.BigEndian.PutUint32(hdr[3:7], uint32(len(f.Payload)))
+
+	if _, err := w.w.Write(hdr[:]); err != nil {
+		return err
+	}
+
+	if _, err := w.w.Write(f.Payload); err != nil {
+		return err
+	}
+
+	return w.w.WriteByte(utils.FrameEnd)
+}
+
+// Flush writes the buffered frames to the output stream
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// NewMethod returns a method frame. args is the encoded argument list
+// of the method and may be nil for methods without arguments.
+func NewMethod(channel, class, method uint16, args *Encoder) (*Frame, error) {
+	e := NewEncoder()
+	e.Short(class)
+	e.Short(method)
+
+	if args != nil {
+		payload, err := args.Bytes()
+
+		if err != nil {
+			return nil, err
+		}
+
+		e.buf.Write(payload)
+	}
+
+	payload, err := e.Bytes()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Frame{Type: utils.FrameMethod, Channel: channel, Payload: payload}, nil
+}
+
+// Method decodes the class and method identifiers of a method frame and
+// returns a decoder of its arguments.
+func (f *Frame) Method() (class, method uint16, args *Decoder, err error) {
+	if f.Type != utils.FrameMethod {
+		return 0, 0, nil, fmt.Errorf("frame: type %d isn't a method frame", f.Type)
+	}
+
+	args = NewDecoder(f.Payload)
+	class, method = args.Short(), args.Short()
+
+	return class, method, args, args.Err()
+}
+
+// ContentHeader is the payload of a content header frame
+type ContentHeader struct {
+	Class      uint16
+	Weight     uint16
+	BodySize   uint64
+	Properties Properties
+}
+
+// NewContentHeader returns a content header frame
+func NewContentHeader(channel uint16, h ContentHeader) (*Frame, error) {
+	e := NewEncoder()
+	e.Short(h.Class)
+	e.Short(h.Weight)
+	e.LongLong(h.BodySize)
+	e.Properties(h.Properties)
+
+	payload, err := e.Bytes()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Frame{Type: utils.FrameHeader, Channel: channel, Payload: payload}, nil
+}
+
+// ContentHeader decodes a content header frame
+func (f *Frame) ContentHeader() (ContentHeader, error) {
+	var h ContentHeader
+
+	if f.Type != utils.FrameHeader {
+		return h, fmt.Errorf("frame: type %d isn't a content header frame", f.Type)
+	}
+
+	d := NewDecoder(f.Payload)
+	h.Class = d.Short()
+	h.Weight = d.Short()
+	h.BodySize = d.LongLong()
+	h.Properties = d.Properties()
+
+	return h, d.Err()
+}
+
+// NewBody splits body in body frames of at most frameMax bytes, counting
+// the frame header and frame end octets.
+func NewBody(channel uint16, body []byte, frameMax uint32) []*Frame {
+	chunk := len(body)
+
+	if frameMax > 8 && int(frameMax-8) < chunk {
+		chunk = int(frameMax - 8)
+	}
+
+	frames := make([]*Frame, 0, 1)
+
+	for len(body) > 0 {
+		n := chunk
+		if n > len(body) {
+			n = len(body)
+		}
+
+		frames = append(frames, &Frame{Type: utils.FrameBody, Channel: channel, Payload: body[:n]})
+		body = body[n:]
+	}
+
+	return frames
+}
+
+// NewHeartbeat returns a heartbeat frame
+func NewHeartbeat() *Frame {
+	return &Frame{Type: utils.FrameHeartbeat}
+}
@@ -0,0 +1,424 @@
+package frame
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/NeowayLabs/wabbit/utils"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var allFields = amqp.Table{
+	"bool":    true,
+	"byte":    byte(7),
+	"int8":    int8(-8),
+	"int16":   int16(-16),
+	"int32":   int32(-32),
+	"int64":   int64(-64),
+	"float32": float32(3.2),
+	"float64": float64(6.4),
+	"decimal": amqp.Decimal{Scale: 2, Value: 12345},
+	"string":  "wabbit",
+	"array":   []interface{}{int32(1), "two", true},
+	"time":    time.Unix(1458470000, 0),
+	"table":   amqp.Table{"nested": "value"},
+	"bytes":   []byte{0, 1, 2},
+	"void":    nil,
+}
+
+func TestTableRoundTrip(t *testing.T) {
+	e := NewEncoder()
+	e.Table(allFields)
+	e.Bit(true)
+	e.Bit(false)
+	e.Bit(true)
+	e.ShortStr("end")
+
+	payload, err := e.Bytes()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	d := NewDecoder(payload)
+	table := d.Table()
+	a, b, c := d.Bit(), d.Bit(), d.Bit()
+	end := d.ShortStr()
+
+	if d.Err() != nil {
+		t.Error(d.Err())
+		return
+	}
+
+	if !reflect.DeepEqual(table, allFields) {
+		t.Errorf("Table differs:\n- want: %#v\n-  got: %#v", allFields, table)
+	}
+
+	if !a || b || !c || end != "end" {
+		t.Errorf("Invalid packed bits or trailing string: %v %v %v %q", a, b, c, end)
+	}
+
+	if d.Len() != 0 {
+		t.Errorf("%d bytes left to decode", d.Len())
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	e := NewEncoder()
+	e.Table(amqp.Table{"invalid": struct{}{}})
+
+	if _, err := e.Bytes(); err != ErrFieldType {
+		t.Errorf("Expected ErrFieldType, got: %v", err)
+	}
+
+	e = NewEncoder()
+	e.ShortStr(string(make([]byte, 256)))
+
+	if _, err := e.Bytes(); err == nil {
+		t.Errorf("Short string of 256 bytes shall fail")
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	var buf bytes.Buffer
+
+	w := NewWriter(&buf)
+	w.WriteFrame(&Frame{Type: utils.FrameMethod, Payload: []byte{0, 10, 0, 10}})
+	w.Flush()
+
+	raw := buf.Bytes()
+	raw[len(raw)-1] = 0
+
+	if _, err := NewReader(bytes.NewReader(raw)).ReadFrame(); err != ErrFrame {
+		t.Errorf("Expected ErrFrame for an invalid frame end, got: %v", err)
+	}
+
+	raw[0] = 42
+
+	if _, err := NewReader(bytes.NewReader(raw)).ReadFrame(); err != ErrFrame {
+		t.Errorf("Expected ErrFrame for an invalid frame type, got: %v", err)
+	}
+
+	r := NewReader(bytes.NewReader([]byte{utils.FrameBody, 0, 1, 0, 0, 1, 0}))
+	r.MaxSize = 128
+
+	if _, err := r.ReadFrame(); err == nil {
+		t.Errorf("Frame bigger than MaxSize shall fail")
+	}
+}
+
+func TestNewBody(t *testing.T) {
+	body := make([]byte, 250)
+	frames := NewBody(1, body, 108)
+
+	if len(frames) != 3 {
+		t.Errorf("Expected 3 body frames, got %d", len(frames))
+		return
+	}
+
+	if len(frames[0].Payload) != 100 || len(frames[2].Payload) != 50 {
+		t.Errorf("Invalid body frame sizes: %d %d", len(frames[0].Payload), len(frames[2].Payload))
+	}
+
+	if len(NewBody(1, nil, 108)) != 0 {
+		t.Errorf("Empty body shall have no body frames")
+	}
+}
+
+// fakeBroker is the server side of a connection with amqp091-go
+type fakeBroker struct {
+	t *testing.T
+	r *Reader
+	w *Writer
+}
+
+func (b *fakeBroker) send(f *Frame, err error) {
+	if err != nil {
+		b.t.Fatal(err)
+	}
+
+	if err = b.w.WriteFrame(f); err != nil {
+		b.t.Fatal(err)
+	}
+
+	if err = b.w.Flush(); err != nil {
+		b.t.Fatal(err)
+	}
+}
+
+func (b *fakeBroker) expect(class, method uint16) (*Frame, *Decoder) {
+	f, err := b.r.ReadFrame()
+
+	if err != nil {
+		b.t.Fatal(err)
+	}
+
+	gotClass, gotMethod, args, err := f.Method()
+
+	if err != nil {
+		b.t.Fatal(err)
+	}
+
+	if gotClass != class || gotMethod != method {
+		b.t.Fatalf("Expected method %d.%d, got %d.%d", class, method, gotClass, gotMethod)
+	}
+
+	return f, args
+}
+
+func TestRoundTripWithAmqp091(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	b := &fakeBroker{t: t, r: NewReader(server), w: NewWriter(server)}
+
+	type dialResult struct {
+		conn *amqp.Connection
+		err  error
+	}
+
+	dialed := make(chan dialResult, 1)
+
+	go func() {
+		conn, err := amqp.Open(client, amqp.Config{
+			SASL: []amqp.Authentication{&amqp.PlainAuth{Username: "guest", Password: "guest"}},
+		})
+		dialed <- dialResult{conn, err}
+	}()
+
+	header, err := b.r.ReadProtocolHeader()
+
+	if err != nil || !bytes.Equal(header, ProtocolHeader) {
+		t.Fatalf("Invalid protocol header %q: %v", header, err)
+	}
+
+	start := NewEncoder()
+	start.Octet(0)
+	start.Octet(9)
+	start.Table(allFields)
+	start.LongStr("PLAIN")
+	start.LongStr("en_US")
+	b.send(NewMethod(0, ClassConnection, ConnectionStart, start))
+
+	_, args := b.expect(ClassConnection, ConnectionStartOk)
+	clientProps := args.Table()
+	mechanism := args.ShortStr()
+
+	if args.Err() != nil {
+		t.Fatal(args.Err())
+	}
+
+	capabilities, _ := clientProps["capabilities"].(amqp.Table)
+
+	if capabilities["publisher_confirms"] != true || mechanism != "PLAIN" {
+		t.Errorf("Invalid client properties: %v %q", clientProps, mechanism)
+	}
+
+	tune := NewEncoder()
+	tune.Short(0)
+	tune.Long(utils.FrameMinSize)
+	tune.Short(0)
+	b.send(NewMethod(0, ClassConnection, ConnectionTune, tune))
+
+	b.expect(ClassConnection, ConnectionTuneOk)
+	b.expect(ClassConnection, ConnectionOpen)
+
+	openOk := NewEncoder()
+	openOk.ShortStr("")
+	b.send(NewMethod(0, ClassConnection, ConnectionOpenOk, openOk))
+
+	res := <-dialed
+
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+
+	if !reflect.DeepEqual(res.conn.Properties, allFields) {
+		t.Errorf("Server properties decoded by amqp091-go differs:\n- want: %#v\n-  got: %#v",
+			allFields, res.conn.Properties)
+	}
+
+	channels := make(chan *amqp.Channel, 1)
+
+	go func() {
+		ch, err := res.conn.Channel()
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		channels <- ch
+	}()
+
+	f, _ := b.expect(ClassChannel, ChannelOpen)
+	channelOpenOk := NewEncoder()
+	channelOpenOk.LongStr("")
+	b.send(NewMethod(f.Channel, ClassChannel, ChannelOpenOk, channelOpenOk))
+
+	ch := <-channels
+
+	if ch == nil {
+		return
+	}
+
+	props := Properties{
+		ContentType:     "application/json",
+		ContentEncoding: "gzip",
+		Headers:         allFields,
+		DeliveryMode:    amqp.Persistent,
+		Priority:        5,
+		CorrelationId:   "correlation",
+		ReplyTo:         "reply-queue",
+		Expiration:      "60000",
+		MessageId:       "message",
+		Timestamp:       time.Unix(1458470000, 0),
+		Type:            "type",
+		UserId:          "guest",
+		AppId:           "wabbit",
+	}
+
+	body := make([]byte, 2*utils.FrameMinSize)
+	for i := range body {
+		body[i] = byte(i)
+	}
+
+	go ch.Publish("exchange", "route", true, false, amqp.Publishing{
+		ContentType:     props.ContentType,
+		ContentEncoding: props.ContentEncoding,
+		Headers:         props.Headers,
+		DeliveryMode:    props.DeliveryMode,
+		Priority:        props.Priority,
+		CorrelationId:   props.CorrelationId,
+		ReplyTo:         props.ReplyTo,
+		Expiration:      props.Expiration,
+		MessageId:       props.MessageId,
+		Timestamp:       props.Timestamp,
+		Type:            props.Type,
+		UserId:          props.UserId,
+		AppId:           props.AppId,
+		Body:            body,
+	})
+
+	_, args = b.expect(ClassBasic, BasicPublish)
+	args.Short()
+	exchange, key, mandatory, immediate := args.ShortStr(), args.ShortStr(), args.Bit(), args.Bit()
+
+	if exchange != "exchange" || key != "route" || !mandatory || immediate {
+		t.Errorf("Invalid basic.publish arguments: %q %q %v %v", exchange, key, mandatory, immediate)
+	}
+
+	f, err = b.r.ReadFrame()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := f.ContentHeader()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Class != ClassBasic || h.BodySize != uint64(len(body)) {
+		t.Errorf("Invalid content header: %+v", h)
+	}
+
+	if !reflect.DeepEqual(h.Properties, props) {
+		t.Errorf("Properties differs:\n- want: %#v\n-  got: %#v", props, h.Properties)
+	}
+
+	var received []byte
+
+	for uint64(len(received)) < h.BodySize {
+		f, err = b.r.ReadFrame()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if f.Type != utils.FrameBody || len(f.Payload) > utils.FrameMinSize-8 {
+			t.Fatalf("Invalid body frame: type %d, %d bytes", f.Type, len(f.Payload))
+		}
+
+		received = append(received, f.Payload...)
+	}
+
+	if !bytes.Equal(received, body) {
+		t.Errorf("Body differs")
+	}
+
+	consumers := make(chan (<-chan amqp.Delivery), 1)
+
+	go func() {
+		deliveries, err := ch.Consume("queue", "consumer", false, false, false, false, nil)
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		consumers <- deliveries
+	}()
+
+	b.expect(ClassBasic, BasicConsume)
+
+	consumeOk := NewEncoder()
+	consumeOk.ShortStr("consumer")
+	b.send(NewMethod(f.Channel, ClassBasic, BasicConsumeOk, consumeOk))
+
+	deliveries := <-consumers
+
+	deliver := NewEncoder()
+	deliver.ShortStr("consumer")
+	deliver.LongLong(42)
+	deliver.Bit(true)
+	deliver.ShortStr("exchange")
+	deliver.ShortStr("route")
+	b.send(NewMethod(f.Channel, ClassBasic, BasicDeliver, deliver))
+	b.send(NewContentHeader(f.Channel, ContentHeader{
+		Class:      ClassBasic,
+		BodySize:   uint64(len(body)),
+		Properties: props,
+	}))
+
+	for _, bf := range NewBody(f.Channel, body, utils.FrameMinSize) {
+		b.send(bf, nil)
+	}
+
+	select {
+	case d := <-deliveries:
+		if d.DeliveryTag != 42 || !d.Redelivered || d.Exchange != "exchange" || d.RoutingKey != "route" {
+			t.Errorf("Invalid basic.deliver decoded by amqp091-go: %+v", d)
+		}
+
+		got := Properties{
+			ContentType:     d.ContentType,
+			ContentEncoding: d.ContentEncoding,
+			Headers:         d.Headers,
+			DeliveryMode:    d.DeliveryMode,
+			Priority:        d.Priority,
+			CorrelationId:   d.CorrelationId,
+			ReplyTo:         d.ReplyTo,
+			Expiration:      d.Expiration,
+			MessageId:       d.MessageId,
+			Timestamp:       d.Timestamp,
+			Type:            d.Type,
+			UserId:          d.UserId,
+			AppId:           d.AppId,
+		}
+
+		if !reflect.DeepEqual(got, props) {
+			t.Errorf("Properties decoded by amqp091-go differs:\n- want: %#v\n-  got: %#v", props, got)
+		}
+
+		if !bytes.Equal(d.Body, body) {
+			t.Errorf("Body decoded by amqp091-go differs")
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Delivery not decoded by amqp091-go")
+	}
+}
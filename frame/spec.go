@@ -0,0 +1,121 @@
+package frame
+
+// Class identifiers
+const (
+	ClassConnection = 10
+	ClassChannel    = 20
+	ClassExchange   = 40
+	ClassQueue      = 50
+	ClassBasic      = 60
+	ClassConfirm    = 85
+	ClassTx         = 90
+)
+
+// Method identifiers of the connection class
+const (
+	ConnectionStart          = 10
+	ConnectionStartOk        = 11
+	ConnectionSecure         = 20
+	ConnectionSecureOk       = 21
+	ConnectionTune           = 30
+	ConnectionTuneOk         = 31
+	ConnectionOpen           = 40
+	ConnectionOpenOk         = 41
+	ConnectionClose          = 50
+	ConnectionCloseOk        = 51
+	ConnectionBlocked        = 60
+	ConnectionUnblocked      = 61
+	ConnectionUpdateSecret   = 70
+	ConnectionUpdateSecretOk = 71
+)
+
+// Method identifiers of the channel class
+const (
+	ChannelOpen    = 10
+	ChannelOpenOk  = 11
+	ChannelFlow    = 20
+	ChannelFlowOk  = 21
+	ChannelClose   = 40
+	ChannelCloseOk = 41
+)
+
+// Method identifiers of the exchange class
+const (
+	ExchangeDeclare   = 10
+	ExchangeDeclareOk = 11
+	ExchangeDelete    = 20
+	ExchangeDeleteOk  = 21
+	ExchangeBind      = 30
+	ExchangeBindOk    = 31
+	ExchangeUnbind    = 40
+	ExchangeUnbindOk  = 51
+)
+
+// Method identifiers of the queue class
+const (
+	QueueDeclare   = 10
+	QueueDeclareOk = 11
+	QueueBind      = 20
+	QueueBindOk    = 21
+	QueuePurge     = 30
+	QueuePurgeOk   = 31
+	QueueDelete    = 40
+	QueueDeleteOk  = 41
+	QueueUnbind    = 50
+	QueueUnbindOk  = 51
+)
+
+// Method identifiers of the basic class
+const (
+	BasicQos          = 10
+	BasicQosOk        = 11
+	BasicConsume      = 20
+	BasicConsumeOk    = 21
+	BasicCancel       = 30
+	BasicCancelOk     = 31
+	BasicPublish      = 40
+	BasicReturn       = 50
+	BasicDeliver      = 60
+	BasicGet          = 70
+	BasicGetOk        = 71
+	BasicGetEmpty     = 72
+	BasicAck          = 80
+	BasicReject       = 90
+	BasicRecoverAsync = 100
+	BasicRecover      = 110
+	BasicRecoverOk    = 111
+	BasicNack         = 120
+)
+
+// Method identifiers of the confirm class
+const (
+	ConfirmSelect   = 10
+	ConfirmSelectOk = 11
+)
+
+// Method identifiers of the tx class
+const (
+	TxSelect     = 10
+	TxSelectOk   = 11
+	TxCommit     = 20
+	TxCommitOk   = 21
+	TxRollback   = 30
+	TxRollbackOk = 31
+)
+
+// Property flags of content headers
+const (
+	FlagContentType     = 0x8000
+	FlagContentEncoding = 0x4000
+	FlagHeaders         = 0x2000
+	FlagDeliveryMode    = 0x1000
+	FlagPriority        = 0x0800
+	FlagCorrelationId   = 0x0400
+	FlagReplyTo         = 0x0200
+	FlagExpiration      = 0x0100
+	FlagMessageId       = 0x0080
+	FlagTimestamp       = 0x0040
+	FlagType            = 0x0020
+	FlagUserId          = 0x0010
+	FlagAppId           = 0x0008
+)
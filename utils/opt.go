@@ -2,6 +2,7 @@ package utils
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/NeowayLabs/wabbit"
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -17,6 +18,14 @@ var (
 		"deliveryMode",
 		"priority",
 		"messageId",
+		"correlationId",
+		"replyTo",
+		"expiration",
+		"timestamp",
+		"type",
+		"userId",
+		"appId",
+		"mandatory",
 	}
 )
 
@@ -38,6 +47,13 @@ func ConvertOpt(opt wabbit.Option) (amqp.Publishing, error) {
 		deliveryMode    = amqp.Transient
 		priority        = uint8(0)
 		messageId       = ""
+		correlationId   = ""
+		replyTo         = ""
+		expiration      = ""
+		timestamp       time.Time
+		messageType     = ""
+		userId          = ""
+		appId           = ""
 	)
 
 	if wrongOpt, ok := checkOptions(opt); !ok {
@@ -68,6 +84,34 @@ func ConvertOpt(opt wabbit.Option) (amqp.Publishing, error) {
 		if p, ok := opt["messageId"].(string); ok {
 			messageId = p
 		}
+
+		if c, ok := opt["correlationId"].(string); ok {
+			correlationId = c
+		}
+
+		if r, ok := opt["replyTo"].(string); ok {
+			replyTo = r
+		}
+
+		if e, ok := opt["expiration"].(string); ok {
+			expiration = e
+		}
+
+		if t, ok := opt["timestamp"].(time.Time); ok {
+			timestamp = t
+		}
+
+		if t, ok := opt["type"].(string); ok {
+			messageType = t
+		}
+
+		if u, ok := opt["userId"].(string); ok {
+			userId = u
+		}
+
+		if a, ok := opt["appId"].(string); ok {
+			appId = a
+		}
 	}
 
 	return amqp.Publishing{
@@ -77,7 +121,13 @@ func ConvertOpt(opt wabbit.Option) (amqp.Publishing, error) {
 		DeliveryMode:    deliveryMode, // 1=non-persistent, 2=persistent
 		Priority:        priority,     // 0-9
 		MessageId:       messageId,
-		// a bunch of application/implementation-specific fields
+		CorrelationId:   correlationId,
+		ReplyTo:         replyTo,
+		Expiration:      expiration, // TTL in milliseconds, eg.: "60000"
+		Timestamp:       timestamp,
+		Type:            messageType,
+		UserId:          userId,
+		AppId:           appId,
 	}, nil
 }
 
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"testing"
+	"time"
 
 	"github.com/NeowayLabs/wabbit"
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -98,6 +99,35 @@ func TestConvertOpt(t *testing.T) {
 		t.Errorf("Invalid value for messageId: %s", opt.MessageId)
 	}
 
+	now := time.Now()
+
+	opt, err = ConvertOpt(wabbit.Option{
+		"correlationId": "abc",
+		"replyTo":       "replies",
+		"expiration":    "60000",
+		"timestamp":     now,
+		"type":          "order.created",
+		"userId":        "guest",
+		"appId":         "billing",
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if opt.CorrelationId != "abc" || opt.ReplyTo != "replies" || opt.Expiration != "60000" {
+		t.Errorf("Invalid values for correlationId, replyTo or expiration: %+v", opt)
+	}
+
+	if !opt.Timestamp.Equal(now) {
+		t.Errorf("Invalid value for timestamp: %s", opt.Timestamp)
+	}
+
+	if opt.Type != "order.created" || opt.UserId != "guest" || opt.AppId != "billing" {
+		t.Errorf("Invalid values for type, userId or appId: %+v", opt)
+	}
+
 	// setting invalid value
 
 	opt, err = ConvertOpt(wabbit.Option{
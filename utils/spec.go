@@ -1,17 +1,23 @@
 package utils
 
+// Frame types and limits of the AMQP 0-9-1 wire protocol. A frame is a
+// 7 octets header (type, channel and payload size), the payload and the
+// FrameEnd octet.
+const (
+	FrameMethod    = 1
+	FrameHeader    = 2
+	FrameBody      = 3
+	FrameHeartbeat = 8
+	FrameMinSize   = 4096
+	FrameEnd       = 206
+)
+
 // Error codes that can be sent from the server during a connection or
 // channel exception or used by the client to indicate a class of error like
 // ErrCredentials.  The text of the error is likely more interesting than
 // these constants.
 const (
-	frameMethod        = 1
-	frameHeader        = 2
-	frameBody          = 3
-	frameHeartbeat     = 8
-	frameMinSize       = 4096
-	frameEnd           = 206
-	replySuccess       = 200
+	ReplySuccess       = 200
 	ContentTooLarge    = 311
 	NoRoute            = 312
 	NoConsumers        = 313